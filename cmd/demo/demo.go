@@ -21,6 +21,14 @@ import (
 var vaultFilename string
 var vaultPassphrase string
 var identityID string
+var attestationType string
+var enterpriseRPIDs []string
+var userVerification bool
+
+var attestationTypes = map[string]virtual_fido.AttestationType{
+	"self":  virtual_fido.AttestationTypeSelf,
+	"basic": virtual_fido.AttestationTypeBasic,
+}
 
 func checkErr(err error, message string) {
 	if err != nil {
@@ -65,7 +73,21 @@ func deleteIdentity(cmd *cobra.Command, args []string) {
 }
 
 func start(cmd *cobra.Command, args []string) {
+	attestation, ok := attestationTypes[attestationType]
+	if !ok && attestationType != "none" {
+		printUsage(fmt.Sprintf("Unknown attestation type '%s'", attestationType))
+		return
+	}
 	client := createClient()
+	if attestationType == "none" {
+		client.SetAttestationFormats(virtual_fido.AttestationFormatNone)
+	} else {
+		client.SetAttestationType(attestation)
+	}
+	client.SetEnterpriseAttestationRPIDs(enterpriseRPIDs...)
+	if userVerification {
+		client.SetUserVerifier(&passphraseVerifier{passphrase: vaultPassphrase})
+	}
 	runServer(client)
 }
 
@@ -120,6 +142,9 @@ func init() {
 		Short: "Attach virtual FIDO device",
 		Run:   start,
 	}
+	start.Flags().StringVarP(&attestationType, "attestation", "", "self", "Attestation type for new credentials (self, basic or none)")
+	start.Flags().StringSliceVarP(&enterpriseRPIDs, "enterprise-rp", "", nil, "Relying party allowed to receive enterprise attestation (repeatable)")
+	start.Flags().BoolVarP(&userVerification, "uv", "", false, "Verify the user by re-entering the vault passphrase")
 	rootCmd.AddCommand(start)
 
 	list := &cobra.Command{
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +29,25 @@ func prompt(prompt string) bool {
 	return false
 }
 
+func promptChoice(prompt string, options []string) int {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println(prompt)
+	for i, option := range options {
+		fmt.Printf("  %d) %s\n", i+1, option)
+	}
+	fmt.Print("--> ")
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Printf("Could not read user input: %s - %s\n", response, err)
+		panic(err)
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(response))
+	if err != nil || choice < 1 || choice > len(options) {
+		return -1
+	}
+	return choice - 1
+}
+
 type ClientSupport struct {
 	vaultFilename   string
 	vaultPassphrase string
@@ -38,7 +58,16 @@ func (support *ClientSupport) ApproveClientAction(action virtual_fido.ClientActi
 	case virtual_fido.ClientActionFIDOGetAssertion:
 		return prompt(fmt.Sprintf("Approve login for \"%s\" with identity \"%s\" (Y/n)?", params.RelyingParty, params.UserName))
 	case virtual_fido.ClientActionFIDOMakeCredential:
+		if params.ReplacesAccount {
+			return prompt(fmt.Sprintf("Approve account creation for \"%s\", replacing identity \"%s\" (Y/n)?", params.RelyingParty, params.UserName))
+		}
 		return prompt(fmt.Sprintf("Approve account creation for \"%s\" (Y/n)?", params.RelyingParty))
+	case virtual_fido.ClientActionFIDOCredentialExcluded:
+		return prompt(fmt.Sprintf("This device is already registered with \"%s\", acknowledge (Y/n)?", params.RelyingParty))
+	case virtual_fido.ClientActionFIDOReset:
+		return prompt("Approve resetting the device, deleting all identities and the PIN (Y/n)?")
+	case virtual_fido.ClientActionFIDOSelectDevice:
+		return prompt("Select this device for the pending request (Y/n)?")
 	case virtual_fido.ClientActionU2FAuthenticate:
 		return prompt("Approve registration of U2F device (Y/n)?")
 	case virtual_fido.ClientActionU2FRegister:
@@ -48,6 +77,14 @@ func (support *ClientSupport) ApproveClientAction(action virtual_fido.ClientActi
 	return false
 }
 
+func (support *ClientSupport) ChooseAccount(accounts []virtual_fido.ClientActionRequestParams) int {
+	names := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		names = append(names, account.UserName)
+	}
+	return promptChoice(fmt.Sprintf("Choose an identity to log in to \"%s\" with (any other input declines):", accounts[0].RelyingParty), names)
+}
+
 func (support *ClientSupport) SaveData(data []byte) {
 	f, err := os.OpenFile(support.vaultFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	checkErr(err, "Could not open vault file")
@@ -70,6 +107,23 @@ func (support *ClientSupport) Passphrase() string {
 	return support.vaultPassphrase
 }
 
+// Verifies the user by asking them to re-enter the vault passphrase
+type passphraseVerifier struct {
+	passphrase string
+}
+
+func (verifier *passphraseVerifier) VerifyUser(params virtual_fido.ClientActionRequestParams) bool {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("Re-enter the vault passphrase to verify yourself for \"%s\":\n", params.RelyingParty)
+	fmt.Print("--> ")
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Printf("Could not read user input: %s - %s\n", response, err)
+		panic(err)
+	}
+	return strings.TrimRight(response, "\r\n") == verifier.passphrase
+}
+
 func runServer(client virtual_fido.FIDOClient) {
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
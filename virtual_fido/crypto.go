@@ -1,14 +1,23 @@
 package virtual_fido
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"math/big"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 func encrypt(key []byte, data []byte) ([]byte, []byte, error) {
@@ -36,6 +45,10 @@ func decrypt(key []byte, data []byte, nonce []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Could not create GCM mode: %w", err)
 	}
+	if len(nonce) != gcm.NonceSize() {
+		// Nonces can come from untrusted credential IDs, and GCM panics on the wrong size
+		return nil, fmt.Errorf("Invalid nonce length: %d", len(nonce))
+	}
 	decryptedData, err := gcm.Open(nil, nonce, data, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Could not decrypt data: %w", err)
@@ -43,11 +56,105 @@ func decrypt(key []byte, data []byte, nonce []byte) ([]byte, error) {
 	return decryptedData, nil
 }
 
-func sign(key *ecdsa.PrivateKey, data []byte) []byte {
-	hash := sha256.Sum256(data)
-	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
-	checkErr(err, "Could not sign data")
-	return signature
+func sign(key crypto.Signer, data []byte) []byte {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		// The hash matches the curve size, so ES384 keys use SHA-384
+		var hash []byte
+		if key.Curve == elliptic.P384() {
+			hash384 := sha512.Sum384(data)
+			hash = hash384[:]
+		} else {
+			hash256 := sha256.Sum256(data)
+			hash = hash256[:]
+		}
+		signature, err := ecdsa.SignASN1(rand.Reader, key, hash)
+		checkErr(err, "Could not sign data")
+		return signature
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(data)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		checkErr(err, "Could not sign data")
+		return signature
+	case ed25519.PrivateKey:
+		// EdDSA signs the message itself rather than a hash of it
+		return ed25519.Sign(key, data)
+	default:
+		panic(fmt.Sprintf("Unsupported private key type: %T", key))
+	}
+}
+
+func generatePrivateKey(algorithm coseAlgorithmID) crypto.Signer {
+	switch algorithm {
+	case cose_ALGORITHM_ID_ES256:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		checkErr(err, "Could not generate private key")
+		return privateKey
+	case cose_ALGORITHM_ID_EDDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		checkErr(err, "Could not generate private key")
+		return privateKey
+	case cose_ALGORITHM_ID_ES384:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		checkErr(err, "Could not generate private key")
+		return privateKey
+	case cose_ALGORITHM_ID_RS256:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		checkErr(err, "Could not generate private key")
+		return privateKey
+	default:
+		panic(fmt.Sprintf("Unsupported algorithm: %d", algorithm))
+	}
+}
+
+func marshalPrivateKey(key crypto.Signer) []byte {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	checkErr(err, "Could not marshal private key")
+	return keyBytes
+}
+
+func parsePrivateKey(keyBytes []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		// Keys used to be saved in SEC 1 form, which only supports ECDSA
+		return x509.ParseECPrivateKey(keyBytes)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type: %T", key)
+	}
+	return signer, nil
+}
+
+// The primes are enough to rebuild an RSA key with the public exponent used by generatePrivateKey
+func marshalRSAPrimes(key *rsa.PrivateKey) [][]byte {
+	assert(len(key.Primes) == 2 && key.E == 65537, "RSA key can't be rebuilt from its primes")
+	return [][]byte{key.Primes[0].Bytes(), key.Primes[1].Bytes()}
+}
+
+func parseRSAPrimes(primes [][]byte) (*rsa.PrivateKey, error) {
+	if len(primes) != 2 {
+		return nil, fmt.Errorf("Expected 2 RSA primes, got %d", len(primes))
+	}
+	p := new(big.Int).SetBytes(primes[0])
+	q := new(big.Int).SetBytes(primes[1])
+	one := big.NewInt(1)
+	totient := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	exponent := big.NewInt(65537)
+	d := new(big.Int).ModInverse(exponent, totient)
+	if d == nil {
+		return nil, fmt.Errorf("Invalid RSA primes")
+	}
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: new(big.Int).Mul(p, q), E: int(exponent.Int64())},
+		D:         d,
+		Primes:    []*big.Int{p, q},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid RSA primes: %w", err)
+	}
+	key.Precompute()
+	return key, nil
 }
 
 func verify(key *ecdsa.PublicKey, data []byte, signature []byte) bool {
@@ -79,20 +186,25 @@ func hashSHA256(bytes []byte) []byte {
 	return hash.Sum(nil)
 }
 
-func encryptAESCBC(key []byte, data []byte) []byte {
+func hmacSHA256(key []byte, data []byte) []byte {
+	hash := hmac.New(sha256.New, key)
+	_, err := hash.Write(data)
+	checkErr(err, "Could not compute HMAC")
+	return hash.Sum(nil)
+}
+
+func encryptAESCBC(key []byte, iv []byte, data []byte) []byte {
 	aesCipher, err := aes.NewCipher(key)
 	checkErr(err, "Could not create AES cipher")
-	iv := make([]byte, aesCipher.BlockSize())
 	cbc := cipher.NewCBCEncrypter(aesCipher, iv)
 	encryptedData := make([]byte, len(data))
 	cbc.CryptBlocks(encryptedData, data)
 	return encryptedData
 }
 
-func decryptAESCBC(key []byte, data []byte) []byte {
+func decryptAESCBC(key []byte, iv []byte, data []byte) []byte {
 	aesCipher, err := aes.NewCipher(key)
 	checkErr(err, "Could not create AES cipher")
-	iv := make([]byte, aesCipher.BlockSize())
 	cbc := cipher.NewCBCDecrypter(aesCipher, iv)
 	decryptedData := make([]byte, len(data))
 	cbc.CryptBlocks(decryptedData, data)
@@ -113,13 +225,20 @@ func generateECDHKey() *ECDHKey {
 
 func (key *ECDHKey) ECDH(remoteX, remoteY *big.Int) []byte {
 	secret, _ := elliptic.P256().Params().ScalarMult(remoteX, remoteY, key.priv)
-	return secret.Bytes()
+	return secret.FillBytes(make([]byte, 32))
 }
 
 func (key *ECDHKey) PublicKeyBytes() []byte {
 	return elliptic.Marshal(elliptic.P256(), key.x, key.y)
 }
 
+func hkdfSHA256(secret []byte, salt []byte, info []byte, length int) []byte {
+	output := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), output)
+	checkErr(err, "Could not derive HKDF key")
+	return output
+}
+
 func randomBytes(length int) []byte {
 	randBytes := make([]byte, length)
 	_, err := rand.Read(randBytes)
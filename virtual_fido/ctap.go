@@ -2,11 +2,21 @@ package virtual_fido
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
+	"runtime/debug"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/fxamacker/cbor/v2"
 )
@@ -15,6 +25,22 @@ var ctapLogger = newLogger("[CTAP] ", false)
 
 var aaguid = [16]byte{117, 108, 90, 245, 236, 166, 1, 163, 47, 198, 211, 12, 226, 242, 1, 197}
 
+// Device firmware version, reported by both CTAPHID_INIT and GET_INFO
+const (
+	deviceVersionMajor uint8 = 0
+	deviceVersionMinor uint8 = 0
+	deviceVersionBuild uint8 = 1
+)
+
+// Largest CTAP message the device accepts, advertised to the platform in GET_INFO
+const ctap_MAX_MESSAGE_SIZE int = ctapHID_MAX_MESSAGE_SIZE
+
+// Largest blob that can be stored with a credential through the credBlob extension
+const ctap_MAX_CRED_BLOB_LENGTH int = 32
+
+// Largest user handle a relying party may assign
+const ctap_MAX_USER_ID_LENGTH int = 64
+
 type ctapCommand uint8
 
 const (
@@ -24,6 +50,12 @@ const (
 	ctap_COMMAND_CLIENT_PIN         ctapCommand = 0x06
 	ctap_COMMAND_RESET              ctapCommand = 0x07
 	ctap_COMMAND_GET_NEXT_ASSERTION ctapCommand = 0x08
+
+	ctap_COMMAND_CREDENTIAL_MANAGEMENT         ctapCommand = 0x0A
+	ctap_COMMAND_SELECTION                     ctapCommand = 0x0B
+	ctap_COMMAND_LARGE_BLOBS                   ctapCommand = 0x0C
+	ctap_COMMAND_AUTHENTICATOR_CONFIG          ctapCommand = 0x0D
+	ctap_COMMAND_CREDENTIAL_MANAGEMENT_PREVIEW ctapCommand = 0x41
 )
 
 var ctapCommandDescriptions = map[ctapCommand]string{
@@ -33,6 +65,12 @@ var ctapCommandDescriptions = map[ctapCommand]string{
 	ctap_COMMAND_CLIENT_PIN:         "ctap_COMMAND_CLIENT_PIN",
 	ctap_COMMAND_RESET:              "ctap_COMMAND_RESET",
 	ctap_COMMAND_GET_NEXT_ASSERTION: "ctap_COMMAND_GET_NEXT_ASSERTION",
+
+	ctap_COMMAND_CREDENTIAL_MANAGEMENT:         "ctap_COMMAND_CREDENTIAL_MANAGEMENT",
+	ctap_COMMAND_SELECTION:                     "ctap_COMMAND_SELECTION",
+	ctap_COMMAND_LARGE_BLOBS:                   "ctap_COMMAND_LARGE_BLOBS",
+	ctap_COMMAND_AUTHENTICATOR_CONFIG:          "ctap_COMMAND_AUTHENTICATOR_CONFIG",
+	ctap_COMMAND_CREDENTIAL_MANAGEMENT_PREVIEW: "ctap_COMMAND_CREDENTIAL_MANAGEMENT_PREVIEW",
 }
 
 type ctapStatusCode byte
@@ -45,32 +83,50 @@ const (
 	ctap1_ERR_INVALID_SEQ       ctapStatusCode = 0x04
 	ctap1_ERR_TIMEOUT           ctapStatusCode = 0x05
 	ctap1_ERR_CHANNEL_BUSY      ctapStatusCode = 0x06
-
-	ctap2_ERR_UNSUPPORTED_ALGORITHM ctapStatusCode = 0x26
-	ctap2_ERR_INVALID_CBOR          ctapStatusCode = 0x12
-	ctap2_ERR_NO_CREDENTIALS        ctapStatusCode = 0x2E
-	ctap2_ERR_OPERATION_DENIED      ctapStatusCode = 0x27
-	ctap2_ERR_MISSING_PARAM         ctapStatusCode = 0x14
-	ctap2_ERR_PIN_INVALID           ctapStatusCode = 0x31
-	ctap2_ERR_PIN_BLOCKED           ctapStatusCode = 0x32
-	ctap2_ERR_PIN_AUTH_INVALID      ctapStatusCode = 0x33
-	ctap2_ERR_NO_PIN_SET            ctapStatusCode = 0x35
-	ctap2_ERR_PIN_REQUIRED          ctapStatusCode = 0x36
-	ctap2_ERR_PIN_POLICY_VIOLATION  ctapStatusCode = 0x37
-	ctap2_ERR_PIN_EXPIRED           ctapStatusCode = 0x38
+	ctap1_ERR_OTHER             ctapStatusCode = 0x7F
+
+	ctap2_ERR_UNSUPPORTED_ALGORITHM   ctapStatusCode = 0x26
+	ctap2_ERR_INVALID_OPTION          ctapStatusCode = 0x2C
+	ctap2_ERR_CBOR_UNEXPECTED_TYPE    ctapStatusCode = 0x11
+	ctap2_ERR_INVALID_CBOR            ctapStatusCode = 0x12
+	ctap2_ERR_CREDENTIAL_EXCLUDED     ctapStatusCode = 0x19
+	ctap2_ERR_NO_CREDENTIALS          ctapStatusCode = 0x2E
+	ctap2_ERR_OPERATION_DENIED        ctapStatusCode = 0x27
+	ctap2_ERR_KEY_STORE_FULL          ctapStatusCode = 0x28
+	ctap2_ERR_MISSING_PARAM           ctapStatusCode = 0x14
+	ctap2_ERR_NOT_ALLOWED             ctapStatusCode = 0x30
+	ctap2_ERR_PIN_INVALID             ctapStatusCode = 0x31
+	ctap2_ERR_PIN_BLOCKED             ctapStatusCode = 0x32
+	ctap2_ERR_PIN_AUTH_INVALID        ctapStatusCode = 0x33
+	ctap2_ERR_PIN_AUTH_BLOCKED        ctapStatusCode = 0x34
+	ctap2_ERR_NO_PIN_SET              ctapStatusCode = 0x35
+	ctap2_ERR_PIN_REQUIRED            ctapStatusCode = 0x36
+	ctap2_ERR_PIN_POLICY_VIOLATION    ctapStatusCode = 0x37
+	ctap2_ERR_PIN_EXPIRED             ctapStatusCode = 0x38
+	ctap2_ERR_UV_BLOCKED              ctapStatusCode = 0x3C
+	ctap2_ERR_INTEGRITY_FAILURE       ctapStatusCode = 0x3D
+	ctap2_ERR_INVALID_SUBCOMMAND      ctapStatusCode = 0x3E
+	ctap2_ERR_UV_INVALID              ctapStatusCode = 0x3F
+	ctap2_ERR_LARGE_BLOB_STORAGE_FULL ctapStatusCode = 0x18
+	ctap2_ERR_UNAUTHORIZED_PERM       ctapStatusCode = 0x40
 )
 
 type coseAlgorithmID int32
 
 const (
 	cose_ALGORITHM_ID_ES256         coseAlgorithmID = -7
+	cose_ALGORITHM_ID_EDDSA         coseAlgorithmID = -8
+	cose_ALGORITHM_ID_ES384         coseAlgorithmID = -35
+	cose_ALGORITHM_ID_RS256         coseAlgorithmID = -257
 	cose_ALGORITHM_ID_ECDH_HKDF_256 coseAlgorithmID = -25
 )
 
 type coseCurveID int32
 
 const (
-	cose_CURVE_ID_P256 coseCurveID = 1
+	cose_CURVE_ID_P256    coseCurveID = 1
+	cose_CURVE_ID_P384    coseCurveID = 2
+	cose_CURVE_ID_ED25519 coseCurveID = 6
 )
 
 type coseKeyType int32
@@ -78,6 +134,7 @@ type coseKeyType int32
 const (
 	cose_KEY_TYPE_OKP       coseKeyType = 0b001
 	cose_KEY_TYPE_EC2       coseKeyType = 0b010
+	cose_KEY_TYPE_RSA       coseKeyType = 0b011
 	cose_KEY_TYPE_SYMMETRIC coseKeyType = 0b100
 )
 
@@ -93,8 +150,8 @@ func (rp PublicKeyCredentialRpEntity) String() string {
 
 type PublicKeyCrendentialUserEntity struct {
 	Id          []byte `cbor:"id" json:"id"`
-	DisplayName string `cbor:"displayName" json:"display_name"`
-	Name        string `cbor:"name" json:"name"`
+	DisplayName string `cbor:"displayName,omitempty" json:"display_name"`
+	Name        string `cbor:"name,omitempty" json:"name"`
 }
 
 func (user PublicKeyCrendentialUserEntity) String() string {
@@ -116,9 +173,14 @@ type PublicKeyCredentialParams struct {
 }
 
 type ctapCommandOptions struct {
-	ResidentKey      bool `cbor:"rk,omitempty"`
-	UserVerification bool `cbor:"uv,omitempty"`
-	UserPresence     bool `cbor:"up,omitempty"`
+	ResidentKey      bool  `cbor:"rk,omitempty"`
+	UserVerification bool  `cbor:"uv,omitempty"`
+	UserPresence     *bool `cbor:"up,omitempty"`
+}
+
+// Platforms usually leave out "up", which defaults to true
+func (options ctapCommandOptions) userPresence() bool {
+	return options.UserPresence == nil || *options.UserPresence
 }
 
 type ctapCOSEPublicKey struct {
@@ -138,15 +200,63 @@ func (key *ctapCOSEPublicKey) String() string {
 		hex.EncodeToString(key.Y))
 }
 
-func ctapEncodeKeyAsCOSE(publicKey *ecdsa.PublicKey) []byte {
-	key := ctapCOSEPublicKey{
-		KeyType:   int8(cose_KEY_TYPE_EC2),
-		Algorithm: int8(cose_ALGORITHM_ID_ES256),
-		Curve:     int8(cose_CURVE_ID_P256),
-		X:         publicKey.X.Bytes(),
-		Y:         publicKey.Y.Bytes(),
+// Platform key agreement keys must be P-256 points, otherwise ECDH can leak the device key
+func (key *ctapCOSEPublicKey) isValidECDHKey() bool {
+	if key.KeyType != int8(cose_KEY_TYPE_EC2) || key.Curve != int8(cose_CURVE_ID_P256) || len(key.X) != 32 || len(key.Y) != 32 {
+		return false
+	}
+	return elliptic.P256().IsOnCurve(bytesToBigInt(key.X), bytesToBigInt(key.Y))
+}
+
+type ctapCOSEOKPPublicKey struct {
+	KeyType   int8   `cbor:"1,keyasint"`  // Key Type
+	Algorithm int8   `cbor:"3,keyasint"`  // Key Algorithm
+	Curve     int8   `cbor:"-1,keyasint"` // Key Curve
+	X         []byte `cbor:"-2,keyasint"`
+}
+
+type ctapCOSERSAPublicKey struct {
+	KeyType   int8   `cbor:"1,keyasint"` // Key Type
+	Algorithm int32  `cbor:"3,keyasint"` // Key Algorithm
+	N         []byte `cbor:"-1,keyasint"`
+	E         []byte `cbor:"-2,keyasint"`
+}
+
+func ctapEncodeKeyAsCOSE(publicKey crypto.PublicKey) []byte {
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		key := ctapCOSEPublicKey{
+			KeyType:   int8(cose_KEY_TYPE_EC2),
+			Algorithm: int8(cose_ALGORITHM_ID_ES256),
+			Curve:     int8(cose_CURVE_ID_P256),
+		}
+		if publicKey.Curve == elliptic.P384() {
+			key.Algorithm = int8(cose_ALGORITHM_ID_ES384)
+			key.Curve = int8(cose_CURVE_ID_P384)
+		}
+		coordinateLength := (publicKey.Curve.Params().BitSize + 7) / 8
+		key.X = publicKey.X.FillBytes(make([]byte, coordinateLength))
+		key.Y = publicKey.Y.FillBytes(make([]byte, coordinateLength))
+		return marshalCBOR(key)
+	case *rsa.PublicKey:
+		key := ctapCOSERSAPublicKey{
+			KeyType:   int8(cose_KEY_TYPE_RSA),
+			Algorithm: int32(cose_ALGORITHM_ID_RS256),
+			N:         publicKey.N.Bytes(),
+			E:         big.NewInt(int64(publicKey.E)).Bytes(),
+		}
+		return marshalCBOR(key)
+	case ed25519.PublicKey:
+		key := ctapCOSEOKPPublicKey{
+			KeyType:   int8(cose_KEY_TYPE_OKP),
+			Algorithm: int8(cose_ALGORITHM_ID_EDDSA),
+			Curve:     int8(cose_CURVE_ID_ED25519),
+			X:         publicKey,
+		}
+		return marshalCBOR(key)
+	default:
+		panic(fmt.Sprintf("Unsupported public key type: %T", publicKey))
 	}
-	return marshalCBOR(key)
 }
 
 const (
@@ -181,54 +291,219 @@ type ctapBasicAttestationStatement struct {
 }
 
 func ctapMakeAttestedCredentialData(credentialSource *CredentialSource) []byte {
-	encodedCredentialPublicKey := ctapEncodeKeyAsCOSE(&credentialSource.PrivateKey.PublicKey)
+	encodedCredentialPublicKey := ctapEncodeKeyAsCOSE(credentialSource.PrivateKey.Public())
 	return flatten([][]byte{aaguid[:], toBE(uint16(len(credentialSource.ID))), credentialSource.ID, encodedCredentialPublicKey})
 }
 
-func ctapMakeAuthData(rpID string, credentialSource *CredentialSource, attestedCredentialData []byte, flags uint8) []byte {
+// Encodes authenticator extension outputs, or returns nil if there are none
+func ctapEncodeExtensionOutputs(outputs interface{}) []byte {
+	encoded := marshalCBOR(outputs)
+	if bytes.Equal(encoded, marshalCBOR(map[string]interface{}{})) {
+		return nil
+	}
+	return encoded
+}
+
+func ctapMakeAuthData(rpID string, credentialSource *CredentialSource, attestedCredentialData []byte, extensions []byte, flags uint8) []byte {
 	if attestedCredentialData != nil {
 		flags = flags | ctap_AUTH_DATA_FLAG_ATTESTED_DATA_INCLUDED
 	} else {
 		attestedCredentialData = []byte{}
 	}
+	if extensions != nil {
+		flags = flags | ctap_AUTH_DATA_FLAG_EXTENSION_DATA_INCLUDED
+	} else {
+		extensions = []byte{}
+	}
 	rpIdHash := sha256.Sum256([]byte(rpID))
-	return flatten([][]byte{rpIdHash[:], {flags}, toBE(credentialSource.SignatureCounter), attestedCredentialData})
+	return flatten([][]byte{rpIdHash[:], {flags}, toBE(credentialSource.SignatureCounter), attestedCredentialData, extensions})
 }
 
+// Reset is only allowed shortly after the device is plugged in, so that
+// software cannot silently wipe an authenticator that has been attached for a while
+const ctap_RESET_TIMEOUT = 10 * time.Second
+
+type ctapCommandHandler func(data []byte) []byte
+
 type ctapServer struct {
 	client FIDOClient
+
+	// State that a power cycle resets. The device can be attached again while a request
+	// is still waiting on the user, so it has its own lock instead of the request lock.
+	powerLock              sync.Locker
+	powerUpTime            time.Time
+	consecutivePINFailures int
+
+	// Implemented commands. GET_INFO advertises features based on which handlers exist.
+	handlers map[ctapCommand]ctapCommandHandler
+
+	// CTAPHID handles each message on its own goroutine, so requests take turns with the
+	// server state and the client's PIN retries
+	lock sync.Locker
+
+	// Length of the longest credential ID the server creates, computed on first use
+	maxCredentialIDLength int
+
+	// Remaining results of an in-progress credential management enumeration
+	rpEnumeration         []PublicKeyCredentialRpEntity
+	credentialEnumeration []CredentialSource
+
+	// Remaining credentials of the last GET_ASSERTION, for GET_NEXT_ASSERTION
+	assertionState *ctapAssertionState
+
+	// Permissions of the current PIN token, or nil if no token has been handed out
+	pinTokenState *ctapPINTokenState
+
+	// Large blob array being written in fragments, or nil if no write is in progress
+	largeBlobsWrite *ctapLargeBlobsWrite
 }
 
 func newCTAPServer(client FIDOClient) *ctapServer {
-	return &ctapServer{client: client}
+	server := &ctapServer{client: client, powerLock: &sync.Mutex{}, powerUpTime: time.Now(), lock: &sync.Mutex{}}
+	server.handlers = map[ctapCommand]ctapCommandHandler{
+		ctap_COMMAND_MAKE_CREDENTIAL:    server.handleMakeCredential,
+		ctap_COMMAND_GET_ASSERTION:      server.handleGetAssertion,
+		ctap_COMMAND_GET_INFO:           server.handleGetInfo,
+		ctap_COMMAND_CLIENT_PIN:         server.handleClientPIN,
+		ctap_COMMAND_RESET:              func(data []byte) []byte { return server.handleReset() },
+		ctap_COMMAND_GET_NEXT_ASSERTION: server.handleGetNextAssertion,
+
+		ctap_COMMAND_CREDENTIAL_MANAGEMENT:         server.handleCredentialManagement,
+		ctap_COMMAND_SELECTION:                     func(data []byte) []byte { return server.handleSelection() },
+		ctap_COMMAND_LARGE_BLOBS:                   server.handleLargeBlobs,
+		ctap_COMMAND_AUTHENTICATOR_CONFIG:          server.handleConfig,
+		ctap_COMMAND_CREDENTIAL_MANAGEMENT_PREVIEW: server.handleCredentialManagement,
+	}
+	return server
+}
+
+func (server *ctapServer) powerUp() {
+	server.powerLock.Lock()
+	defer server.powerLock.Unlock()
+	server.powerUpTime = time.Now()
+	server.consecutivePINFailures = 0
 }
 
-func (server *ctapServer) handleMessage(data []byte) []byte {
+func (server *ctapServer) timeSincePowerUp() time.Duration {
+	server.powerLock.Lock()
+	defer server.powerLock.Unlock()
+	return time.Since(server.powerUpTime)
+}
+
+// Too many wrong PINs in a row block PIN entry until the device is power cycled
+func (server *ctapServer) pinAuthBlocked() bool {
+	server.powerLock.Lock()
+	defer server.powerLock.Unlock()
+	return server.consecutivePINFailures >= ctap_MAX_CONSECUTIVE_PIN_FAILURES
+}
+
+// Counts a wrong PIN, returning whether PIN entry is now blocked until a power cycle
+func (server *ctapServer) recordPINFailure() bool {
+	server.powerLock.Lock()
+	defer server.powerLock.Unlock()
+	server.consecutivePINFailures++
+	return server.consecutivePINFailures >= ctap_MAX_CONSECUTIVE_PIN_FAILURES
+}
+
+func (server *ctapServer) clearPINFailures() {
+	server.powerLock.Lock()
+	defer server.powerLock.Unlock()
+	server.consecutivePINFailures = 0
+}
+
+// Handles a single CTAP request. A request that makes a handler panic fails on its own,
+// instead of taking down the whole device.
+func (server *ctapServer) handleMessage(data []byte) (response []byte) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	defer func() {
+		if err := recover(); err != nil {
+			ctapLogger.Printf("ERROR: Request failed: %v\n%s\n\n", err, debug.Stack())
+			response = []byte{byte(ctap1_ERR_OTHER)}
+		}
+	}()
+	if len(data) == 0 {
+		return []byte{byte(ctap1_ERR_INVALID_LENGTH)}
+	}
 	command := ctapCommand(data[0])
 	ctapLogger.Printf("CTAP COMMAND: %s\n\n", ctapCommandDescriptions[command])
-	switch command {
-	case ctap_COMMAND_MAKE_CREDENTIAL:
-		return server.handleMakeCredential(data[1:])
-	case ctap_COMMAND_GET_INFO:
-		return server.handleGetInfo(data[1:])
-	case ctap_COMMAND_GET_ASSERTION:
-		return server.handleGetAssertion(data[1:])
-	case ctap_COMMAND_CLIENT_PIN:
-		return server.handleClientPIN(data[1:])
-	default:
-		panic(fmt.Sprintf("Invalid CTAP Command: %d", command))
+	if command != ctap_COMMAND_GET_NEXT_ASSERTION {
+		server.assertionState = nil
 	}
+	handler, ok := server.handlers[command]
+	if !ok {
+		ctapLogger.Printf("ERROR: Invalid CTAP Command: %d\n\n", command)
+		return []byte{byte(ctap1_ERR_INVALID_COMMAND)}
+	}
+	return handler(data[1:])
+}
+
+// CTAP2 messages may nest at most four levels deep
+const ctap_MAX_CBOR_NESTING_LEVELS int = 4
+
+// Requests must not contain duplicate map keys, indefinite lengths or tags
+var ctapRequestDecMode = func() cbor.DecMode {
+	options := cbor.DecOptions{
+		DupMapKey:       cbor.DupMapKeyEnforcedAPF,
+		IndefLength:     cbor.IndefLengthForbidden,
+		TagsMd:          cbor.TagsForbidden,
+		MaxNestedLevels: ctap_MAX_CBOR_NESTING_LEVELS,
+	}
+	mode, err := options.DecMode()
+	checkErr(err, "Could not create CBOR decoding mode")
+	return mode
+}()
+
+// Decodes the CBOR parameters of a request. A request without parameters decodes to zero
+// values, so that the handler reports which required parameters are missing.
+func ctapDecodeRequest(data []byte, args interface{}) ctapStatusCode {
+	if len(data) == 0 {
+		return ctap1_ERR_SUCCESS
+	}
+	err := ctapRequestDecMode.Unmarshal(data, args)
+	if err == nil {
+		return ctap1_ERR_SUCCESS
+	}
+	ctapLogger.Printf("ERROR: Could not decode request: %s\n\n", err)
+	var typeError *cbor.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return ctap2_ERR_CBOR_UNEXPECTED_TYPE
+	}
+	return ctap2_ERR_INVALID_CBOR
+}
+
+func (server *ctapServer) handlesCommand(command ctapCommand) bool {
+	_, ok := server.handlers[command]
+	return ok
+}
+
+type ctapMakeCredentialExtensions struct {
+	LargeBlobKey *bool  `cbor:"largeBlobKey,omitempty"`
+	MinPINLength bool   `cbor:"minPinLength,omitempty"`
+	HMACSecret   bool   `cbor:"hmac-secret,omitempty"`
+	CredProtect  uint8  `cbor:"credProtect,omitempty"`
+	CredBlob     []byte `cbor:"credBlob,omitempty"`
+}
+
+type ctapMakeCredentialExtensionOutputs struct {
+	MinPINLength uint32 `cbor:"minPinLength,omitempty"`
+	HMACSecret   bool   `cbor:"hmac-secret,omitempty"`
+	CredProtect  uint8  `cbor:"credProtect,omitempty"`
+	CredBlob     *bool  `cbor:"credBlob,omitempty"`
 }
 
 type ctapMakeCredentialArgs struct {
-	ClientDataHash   []byte                          `cbor:"1,keyasint,omitempty"`
-	Rp               PublicKeyCredentialRpEntity     `cbor:"2,keyasint,omitempty"`
-	User             PublicKeyCrendentialUserEntity  `cbor:"3,keyasint,omitempty"`
-	PubKeyCredParams []PublicKeyCredentialParams     `cbor:"4,keyasint,omitempty"`
-	ExcludeList      []PublicKeyCredentialDescriptor `cbor:"5,keyasint,omitempty"`
-	Options          *ctapCommandOptions             `cbor:"7,keyasint,omitempty"`
-	PinAuth          []byte                          `cbor:"8,keyasint,omitempty"`
-	PinProtocol      uint32                          `cbor:"9,keyasint,omitempty"`
+	ClientDataHash               []byte                          `cbor:"1,keyasint,omitempty"`
+	Rp                           PublicKeyCredentialRpEntity     `cbor:"2,keyasint,omitempty"`
+	User                         PublicKeyCrendentialUserEntity  `cbor:"3,keyasint,omitempty"`
+	PubKeyCredParams             []PublicKeyCredentialParams     `cbor:"4,keyasint,omitempty"`
+	ExcludeList                  []PublicKeyCredentialDescriptor `cbor:"5,keyasint,omitempty"`
+	Extensions                   ctapMakeCredentialExtensions    `cbor:"6,keyasint,omitempty"`
+	Options                      *ctapCommandOptions             `cbor:"7,keyasint,omitempty"`
+	PinAuth                      []byte                          `cbor:"8,keyasint,omitempty"`
+	PinProtocol                  uint32                          `cbor:"9,keyasint,omitempty"`
+	EnterpriseAttestation        ctapEnterpriseAttestation       `cbor:"10,keyasint,omitempty"`
+	AttestationFormatsPreference []string                        `cbor:"11,keyasint,omitempty"`
 }
 
 func (args ctapMakeCredentialArgs) String() string {
@@ -242,168 +517,443 @@ func (args ctapMakeCredentialArgs) String() string {
 }
 
 type ctapMakeCredentialReponse struct {
-	FormatIdentifer      string                       `cbor:"1,keyasint"`
-	AuthData             []byte                       `cbor:"2,keyasint"`
-	AttestationStatement ctapSelfAttestationStatement `cbor:"3,keyasint"`
+	FormatIdentifer       string      `cbor:"1,keyasint"`
+	AuthData              []byte      `cbor:"2,keyasint"`
+	AttestationStatement  interface{} `cbor:"3,keyasint"`
+	EnterpriseAttestation bool        `cbor:"4,keyasint,omitempty"`
+	LargeBlobKey          []byte      `cbor:"5,keyasint,omitempty"`
+}
+
+// Credential algorithms the authenticator can generate keys for
+var ctapSupportedAlgorithms = []coseAlgorithmID{
+	cose_ALGORITHM_ID_ES256,
+	cose_ALGORITHM_ID_EDDSA,
+	cose_ALGORITHM_ID_ES384,
+	cose_ALGORITHM_ID_RS256,
+}
+
+func ctapSupportedAlgorithmParams() []PublicKeyCredentialParams {
+	params := make([]PublicKeyCredentialParams, 0, len(ctapSupportedAlgorithms))
+	for _, algorithm := range ctapSupportedAlgorithms {
+		params = append(params, PublicKeyCredentialParams{Type: "public-key", Algorithm: algorithm})
+	}
+	return params
+}
+
+// Picks the relying party's most preferred algorithm that the authenticator supports
+func ctapNegotiateAlgorithm(params []PublicKeyCredentialParams) (coseAlgorithmID, bool) {
+	for _, param := range params {
+		if param.Type != "public-key" {
+			continue
+		}
+		for _, algorithm := range ctapSupportedAlgorithms {
+			if param.Algorithm == algorithm {
+				return algorithm, true
+			}
+		}
+	}
+	return 0, false
 }
 
 func (server *ctapServer) handleMakeCredential(data []byte) []byte {
 	var args ctapMakeCredentialArgs
-	err := cbor.Unmarshal(data, &args)
-	checkErr(err, fmt.Sprintf("Could not decode CBOR for MAKE_CREDENTIAL: %s %v", err, data))
+	status := ctapDecodeRequest(data, &args)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
 	ctapLogger.Printf("MAKE CREDENTIAL: %s\n\n", args)
+	if args.ClientDataHash == nil || args.Rp.Id == "" || args.User.Id == nil || args.PubKeyCredParams == nil {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	if len(args.ClientDataHash) != sha256.Size || len(args.User.Id) > ctap_MAX_USER_ID_LENGTH {
+		return []byte{byte(ctap1_ERR_INVALID_LENGTH)}
+	}
 	var flags uint8 = 0
 
-	supported := false
-	for _, param := range args.PubKeyCredParams {
-		if param.Algorithm == cose_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-		}
-	}
+	residentKey := args.Options != nil && args.Options.ResidentKey
+	algorithm, supported := ctapNegotiateAlgorithm(args.PubKeyCredParams)
 	if !supported {
 		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
 		return []byte{byte(ctap2_ERR_UNSUPPORTED_ALGORITHM)}
 	}
 
-	if args.PinProtocol == 1 {
-		pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-		if !bytes.Equal(pinAuth, args.PinAuth) {
-			return []byte{byte(ctap2_ERR_PIN_AUTH_INVALID)}
+	if args.EnterpriseAttestation != 0 {
+		if !server.client.AuthenticatorConfig().EnterpriseAttestation {
+			return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+		}
+		if args.EnterpriseAttestation != ctap_ENTERPRISE_ATTESTATION_VENDOR_FACILITATED && args.EnterpriseAttestation != ctap_ENTERPRISE_ATTESTATION_PLATFORM_MANAGED {
+			return []byte{byte(ctap2_ERR_INVALID_OPTION)}
+		}
+	}
+
+	if args.PinAuth != nil && len(args.PinAuth) == 0 {
+		return server.handleSelectionProbe()
+	}
+	if args.PinAuth != nil {
+		status = server.verifyPINAuth(args.PinProtocol, args.PinAuth, args.ClientDataHash, ctap_PIN_TOKEN_PERMISSION_MAKE_CREDENTIAL, args.Rp.Id)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+		flags = flags | ctap_AUTH_DATA_FLAG_USER_VERIFIED
+	} else if (args.Options != nil && args.Options.UserVerification) || server.builtInUVRequired() {
+		status = server.performBuiltInUV(args.Rp.Name)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
 		}
 		flags = flags | ctap_AUTH_DATA_FLAG_USER_VERIFIED
 	} else {
 		if server.client.PINHash() != nil {
 			return []byte{byte(ctap2_ERR_PIN_REQUIRED)}
 		}
+		if server.client.AuthenticatorConfig().AlwaysUV {
+			return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+		}
 	}
 
-	if !server.client.ApproveAccountCreation(args.Rp.Name) {
+	if args.Extensions.LargeBlobKey != nil && (!*args.Extensions.LargeBlobKey || !residentKey) {
+		return []byte{byte(ctap2_ERR_INVALID_OPTION)}
+	}
+
+	userVerified := flags&ctap_AUTH_DATA_FLAG_USER_VERIFIED != 0
+	for _, descriptor := range args.ExcludeList {
+		if server.recognizesCredential(args.Rp.Id, descriptor.Id, userVerified) {
+			// The user has to be present before learning that the device is already registered
+			if !server.client.ApproveCredentialExcluded(args.Rp.Name) {
+				ctapLogger.Printf("ERROR: Unapproved action (Credential excluded)")
+				return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+			}
+			ctapLogger.Printf("ERROR: Credential excluded\n\n")
+			return []byte{byte(ctap2_ERR_CREDENTIAL_EXCLUDED)}
+		}
+	}
+
+	// A new credential overwrites the one stored for the same user on the relying party
+	var replaced *CredentialSource
+	if residentKey {
+		replaced = server.findUserIdentity(args.Rp.Id, args.User.Id)
+	}
+	if !server.client.ApproveAccountCreation(args.Rp.Name, replaced) {
 		ctapLogger.Printf("ERROR: Unapproved action (Create account)")
 		return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
 	}
 	flags = flags | ctap_AUTH_DATA_FLAG_USER_PRESENT
+	if residentKey && replaced == nil && server.remainingResidentCredentials() == 0 {
+		ctapLogger.Printf("ERROR: No room for another resident credential\n\n")
+		return []byte{byte(ctap2_ERR_KEY_STORE_FULL)}
+	}
 
-	credentialSource := server.client.NewCredentialSource(args.Rp, args.User)
+	options := CredentialOptions{
+		Algorithm:    algorithm,
+		Discoverable: residentKey,
+		LargeBlobKey: args.Extensions.LargeBlobKey != nil,
+		HMACSecret:   args.Extensions.HMACSecret,
+	}
+	credProtect := CredentialProtection(args.Extensions.CredProtect)
+	if credProtect >= CredentialProtectionUVOptional && credProtect <= CredentialProtectionUVRequired {
+		// Unknown protection levels are ignored
+		options.CredProtect = credProtect
+	}
+	storeCredBlob := args.Extensions.CredBlob != nil && len(args.Extensions.CredBlob) <= ctap_MAX_CRED_BLOB_LENGTH
+	if storeCredBlob {
+		options.CredBlob = args.Extensions.CredBlob
+	}
+	credentialSource := server.client.NewCredentialSource(args.Rp, args.User, options)
+	if !residentKey {
+		credentialSource.ID = server.wrapCredential(credentialSource)
+	}
 	attestedCredentialData := ctapMakeAttestedCredentialData(credentialSource)
-	authenticatorData := ctapMakeAuthData(args.Rp.Id, credentialSource, attestedCredentialData, flags)
+	extensions := ctapMakeCredentialExtensionOutputs{HMACSecret: args.Extensions.HMACSecret}
+	if options.CredProtect != 0 {
+		extensions.CredProtect = uint8(credentialSource.CredProtect)
+	}
+	if args.Extensions.CredBlob != nil {
+		extensions.CredBlob = &storeCredBlob
+	}
+	if args.Extensions.MinPINLength {
+		config := server.client.AuthenticatorConfig()
+		for _, rpID := range config.MinPINLengthRPIDs {
+			if rpID == args.Rp.Id {
+				extensions.MinPINLength = config.MinPINLength
+			}
+		}
+	}
+	authenticatorData := ctapMakeAuthData(args.Rp.Id, credentialSource, attestedCredentialData, ctapEncodeExtensionOutputs(extensions), flags)
 
-	attestationSignature := sign(credentialSource.PrivateKey, append(authenticatorData, args.ClientDataHash...))
-	attestationStatement := ctapSelfAttestationStatement{
-		Alg: cose_ALGORITHM_ID_ES256,
-		Sig: attestationSignature,
+	var format string
+	var attestationStatement interface{}
+	enterprise := server.enterpriseAttestationApplies(args.EnterpriseAttestation, args.Rp.Id)
+	if enterprise {
+		format, attestationStatement = server.makeEnterpriseAttestation(authenticatorData, args.ClientDataHash)
+	} else {
+		format, attestationStatement = server.makeAttestation(credentialSource, algorithm, authenticatorData, args.ClientDataHash, args.AttestationFormatsPreference)
 	}
 
 	response := ctapMakeCredentialReponse{
-		AuthData:             authenticatorData,
-		FormatIdentifer:      "packed",
-		AttestationStatement: attestationStatement,
+		AuthData:              authenticatorData,
+		FormatIdentifer:       format,
+		AttestationStatement:  attestationStatement,
+		EnterpriseAttestation: enterprise,
+		LargeBlobKey:          credentialSource.LargeBlobKey,
 	}
 	ctapLogger.Printf("MAKE CREDENTIAL RESPONSE: %#v\n\n", response)
 	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
 }
 
-type ctapGetInfoOptions struct {
-	IsPlatform      bool `cbor:"plat"`
-	CanResidentKey  bool `cbor:"rk"`
-	HasClientPIN    bool `cbor:"clientPin"`
-	CanUserPresence bool `cbor:"up"`
-	// CanUserVerification bool `cbor:"uv"`
-}
-
-type ctapGetInfoResponse struct {
-	Versions []string `cbor:"1,keyasint,omitempty"`
-	//Extensions []string `cbor:"2,keyasint,omitempty"`
-	AAGUID  [16]byte           `cbor:"3,keyasint,omitempty"`
-	Options ctapGetInfoOptions `cbor:"4,keyasint,omitempty"`
-	//MaxMessageSize uint32   `cbor:"5,keyasint,omitempty"`
-	PinProtocols []uint32 `cbor:"6,keyasint,omitempty"`
-}
-
-func (server *ctapServer) handleGetInfo(data []byte) []byte {
-	response := ctapGetInfoResponse{
-		Versions: []string{"FIDO_2_0", "U2F_V2"},
-		AAGUID:   aaguid,
-		Options: ctapGetInfoOptions{
-			IsPlatform:      false,
-			CanResidentKey:  true,
-			CanUserPresence: true,
-			HasClientPIN:    server.client.PINHash() != nil,
-			// CanUserVerification: true,
-		},
-		PinProtocols: []uint32{1},
+// Whether the credential ID refers to a credential of this device for the relying party,
+// either stored in the vault or wrapped in the ID itself
+func (server *ctapServer) recognizesCredential(rpID string, credentialID []byte, userVerified bool) bool {
+	source := server.findIdentity(credentialID)
+	if source != nil {
+		return source.RelyingParty.Id == rpID && source.usable(userVerified, true)
 	}
-	ctapLogger.Printf("CTAP GET_INFO RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+	source = server.unwrapCredential(rpID, credentialID)
+	return source != nil && source.usable(userVerified, true)
+}
+
+type ctapGetAssertionExtensions struct {
+	LargeBlobKey *bool                `cbor:"largeBlobKey,omitempty"`
+	HMACSecret   *ctapHMACSecretInput `cbor:"hmac-secret,omitempty"`
+	CredBlob     bool                 `cbor:"credBlob,omitempty"`
+}
+
+type ctapGetAssertionExtensionOutputs struct {
+	HMACSecret []byte  `cbor:"hmac-secret,omitempty"`
+	CredBlob   *[]byte `cbor:"credBlob,omitempty"`
 }
 
 type ctapGetAssertionArgs struct {
 	RpID           string                          `cbor:"1,keyasint"`
 	ClientDataHash []byte                          `cbor:"2,keyasint"`
 	AllowList      []PublicKeyCredentialDescriptor `cbor:"3,keyasint"`
+	Extensions     ctapGetAssertionExtensions      `cbor:"4,keyasint,omitempty"`
 	Options        ctapCommandOptions              `cbor:"5,keyasint"`
 	PinAuth        []byte                          `cbor:"6,keyasint,omitempty"`
 	PinProtocol    uint32                          `cbor:"7,keyasint,omitempty"`
 }
 
 type ctapGetAssertionResponse struct {
-	//Credential          *PublicKeyCredentialDescriptor  `cbor:"1,keyasint,omitempty"`
-	AuthenticatorData []byte `cbor:"2,keyasint"`
-	Signature         []byte `cbor:"3,keyasint"`
-	//User                *PublicKeyCrendentialUserEntity `cbor:"4,keyasint,omitempty"`
-	//NumberOfCredentials int32 `cbor:"5,keyasint"`
+	Credential          *PublicKeyCredentialDescriptor  `cbor:"1,keyasint,omitempty"`
+	AuthenticatorData   []byte                          `cbor:"2,keyasint"`
+	Signature           []byte                          `cbor:"3,keyasint"`
+	User                *PublicKeyCrendentialUserEntity `cbor:"4,keyasint,omitempty"`
+	NumberOfCredentials int32                           `cbor:"5,keyasint,omitempty"`
+	UserSelected        bool                            `cbor:"6,keyasint,omitempty"`
+	LargeBlobKey        []byte                          `cbor:"7,keyasint,omitempty"`
+}
+
+// Time after which the remaining credentials of a GET_ASSERTION can no longer
+// be retrieved through GET_NEXT_ASSERTION
+const ctap_GET_NEXT_ASSERTION_TIMEOUT = 30 * time.Second
+
+type ctapAssertionState struct {
+	args              ctapGetAssertionArgs
+	flags             uint8
+	hmacSecret        *ctapHMACSecretRequest
+	credentialSources []*CredentialSource
+	lastUsed          time.Time
 }
 
 func (server *ctapServer) handleGetAssertion(data []byte) []byte {
 	var flags uint8 = 0
 	var args ctapGetAssertionArgs
-	err := cbor.Unmarshal(data, &args)
-	if err != nil {
-		ctapLogger.Printf("ERROR: %s", err)
-		return []byte{byte(ctap2_ERR_INVALID_CBOR)}
+	status := ctapDecodeRequest(data, &args)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
 	}
 	ctapLogger.Printf("GET ASSERTION: %#v\n\n", args)
+	if args.ClientDataHash == nil || args.RpID == "" {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	if len(args.ClientDataHash) != sha256.Size {
+		return []byte{byte(ctap1_ERR_INVALID_LENGTH)}
+	}
 
+	if args.PinAuth != nil && len(args.PinAuth) == 0 {
+		return server.handleSelectionProbe()
+	}
 	if args.PinAuth != nil {
-		if args.PinProtocol != 1 {
-			return []byte{byte(ctap2_ERR_PIN_AUTH_INVALID)}
+		status = server.verifyPINAuth(args.PinProtocol, args.PinAuth, args.ClientDataHash, ctap_PIN_TOKEN_PERMISSION_GET_ASSERTION, args.RpID)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
 		}
-		pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-		if !bytes.Equal(pinAuth, args.PinAuth) {
-			return []byte{byte(ctap2_ERR_PIN_AUTH_INVALID)}
+		flags = flags | ctap_AUTH_DATA_FLAG_USER_VERIFIED
+	} else if args.Options.UserVerification || server.builtInUVRequired() {
+		status = server.performBuiltInUV(args.RpID)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
 		}
 		flags = flags | ctap_AUTH_DATA_FLAG_USER_VERIFIED
+	} else if server.client.AuthenticatorConfig().AlwaysUV {
+		if server.client.PINHash() != nil {
+			return []byte{byte(ctap2_ERR_PIN_REQUIRED)}
+		}
+		return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+	}
+
+	if args.Extensions.LargeBlobKey != nil && !*args.Extensions.LargeBlobKey {
+		return []byte{byte(ctap2_ERR_INVALID_OPTION)}
+	}
+	var hmacSecret *ctapHMACSecretRequest
+	if args.Extensions.HMACSecret != nil {
+		var status ctapStatusCode
+		hmacSecret, status = server.parseHMACSecretInput(args.Extensions.HMACSecret)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
 	}
 
-	credentialSource := server.client.GetAssertionSource(args.RpID, args.AllowList)
-	if credentialSource == nil {
+	userVerified := flags&ctap_AUTH_DATA_FLAG_USER_VERIFIED != 0
+	credentialSources := server.client.GetAssertionSources(args.RpID, args.AllowList, userVerified)
+	if len(credentialSources) == 0 {
+		credentialSources = server.unwrapAllowList(args.RpID, args.AllowList, userVerified)
+	}
+	if len(credentialSources) == 0 {
 		ctapLogger.Printf("ERROR: No Credentials\n\n")
 		return []byte{byte(ctap2_ERR_NO_CREDENTIALS)}
 	}
+	if len(args.AllowList) > 0 {
+		// With an allow list, the platform already knows which credential it wants
+		credentialSources = credentialSources[:1]
+	}
 
-	if args.Options.UserPresence {
-		if !server.client.ApproveAccountLogin(credentialSource) {
+	userSelected := false
+	if args.Options.userPresence() && len(credentialSources) > 1 && server.client.CanChooseAccount() {
+		// The user picks the account on the device, so only that one is returned
+		credentialSource := server.client.ChooseAccountLogin(credentialSources)
+		if credentialSource == nil {
 			ctapLogger.Printf("ERROR: Unapproved action (Account login)")
 			return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
 		}
+		credentialSources = []*CredentialSource{credentialSource}
+		userSelected = true
 		flags = flags | ctap_AUTH_DATA_FLAG_USER_PRESENT
+	} else if args.Options.userPresence() {
+		if !server.client.ApproveAccountLogin(credentialSources[0]) {
+			ctapLogger.Printf("ERROR: Unapproved action (Account login)")
+			return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+		}
+		flags = flags | ctap_AUTH_DATA_FLAG_USER_PRESENT
+	}
+
+	response := server.makeAssertion(args, credentialSources[0], flags, hmacSecret)
+	response.UserSelected = userSelected
+	if len(credentialSources) > 1 {
+		response.NumberOfCredentials = int32(len(credentialSources))
+		server.assertionState = &ctapAssertionState{
+			args:              args,
+			flags:             flags,
+			hmacSecret:        hmacSecret,
+			credentialSources: credentialSources[1:],
+			lastUsed:          time.Now(),
+		}
 	}
 
-	authData := ctapMakeAuthData(args.RpID, credentialSource, nil, flags)
+	ctapLogger.Printf("RESPONSE: %#v\n\n", response)
+
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) handleGetNextAssertion(data []byte) []byte {
+	state := server.assertionState
+	if state == nil || len(state.credentialSources) == 0 {
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	if time.Since(state.lastUsed) > ctap_GET_NEXT_ASSERTION_TIMEOUT {
+		server.assertionState = nil
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	credentialSource := state.credentialSources[0]
+	state.credentialSources = state.credentialSources[1:]
+	state.lastUsed = time.Now()
+
+	response := server.makeAssertion(state.args, credentialSource, state.flags, state.hmacSecret)
+	ctapLogger.Printf("GET NEXT ASSERTION RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) makeAssertion(args ctapGetAssertionArgs, credentialSource *CredentialSource, flags uint8, hmacSecret *ctapHMACSecretRequest) ctapGetAssertionResponse {
+	server.client.IncrementSignatureCounter(credentialSource)
+	var extensions ctapGetAssertionExtensionOutputs
+	if hmacSecret != nil {
+		extensions.HMACSecret = hmacSecret.output(credentialSource, flags&ctap_AUTH_DATA_FLAG_USER_VERIFIED != 0)
+	}
+	if args.Extensions.CredBlob {
+		// An empty blob is returned for credentials created without one
+		credBlob := credentialSource.CredBlob
+		if credBlob == nil {
+			credBlob = []byte{}
+		}
+		extensions.CredBlob = &credBlob
+	}
+	authData := ctapMakeAuthData(args.RpID, credentialSource, nil, ctapEncodeExtensionOutputs(extensions), flags)
 	signature := sign(credentialSource.PrivateKey, flatten([][]byte{authData, args.ClientDataHash}))
 
+	descriptor := credentialSource.ctapDescriptor()
 	response := ctapGetAssertionResponse{
-		//Credential:          credentialSource.ctapDescriptor(),
+		Credential:        &descriptor,
 		AuthenticatorData: authData,
 		Signature:         signature,
-		//User:                credentialSource.User,
-		//NumberOfCredentials: 1,
 	}
+	if len(args.AllowList) == 0 {
+		// User identifiable information is only returned after user verification
+		user := PublicKeyCrendentialUserEntity{Id: credentialSource.User.Id}
+		if flags&ctap_AUTH_DATA_FLAG_USER_VERIFIED != 0 {
+			user = credentialSource.User
+		}
+		response.User = &user
+	}
+	if args.Extensions.LargeBlobKey != nil {
+		response.LargeBlobKey = credentialSource.LargeBlobKey
+	}
+	return response
+}
 
-	ctapLogger.Printf("RESPONSE: %#v\n\n", response)
+func (server *ctapServer) handleReset() []byte {
+	if server.timeSincePowerUp() > ctap_RESET_TIMEOUT {
+		ctapLogger.Printf("ERROR: Reset requested more than %v after power up\n\n", ctap_RESET_TIMEOUT)
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	if !server.client.ApproveReset() {
+		ctapLogger.Printf("ERROR: Unapproved action (Reset)")
+		return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+	}
+	server.client.Reset()
+	server.rpEnumeration = nil
+	server.credentialEnumeration = nil
+	server.assertionState = nil
+	server.pinTokenState = nil
+	server.largeBlobsWrite = nil
+	server.clearPINFailures()
+	return []byte{byte(ctap1_ERR_SUCCESS)}
+}
 
-	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+func (server *ctapServer) handleSelection() []byte {
+	if !server.client.ApproveDeviceSelection() {
+		ctapLogger.Printf("ERROR: Unapproved action (Device selection)")
+		return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+	}
+	return []byte{byte(ctap1_ERR_SUCCESS)}
 }
 
+// Platforms send an empty pinAuth to have the user touch the device they want to use,
+// after which they check the returned error to know whether a PIN must be set or entered
+func (server *ctapServer) handleSelectionProbe() []byte {
+	if !server.client.ApproveDeviceSelection() {
+		ctapLogger.Printf("ERROR: Unapproved action (Device selection)")
+		return []byte{byte(ctap2_ERR_OPERATION_DENIED)}
+	}
+	if server.client.PINHash() != nil {
+		return []byte{byte(ctap2_ERR_PIN_INVALID)}
+	}
+	return []byte{byte(ctap2_ERR_NO_PIN_SET)}
+}
+
+// Wrong PINs allowed before the PIN is blocked until the device is reset
+const ctap_MAX_PIN_RETRIES int32 = 8
+
+// Wrong PINs allowed in a row before the device must be power cycled to try again
+const ctap_MAX_CONSECUTIVE_PIN_FAILURES int = 3
+
 type ctapClientPINSubcommand uint32
 
 const (
@@ -412,6 +962,10 @@ const (
 	ctap_CLIENT_PIN_SUBCOMMAND_SET_PIN           ctapClientPINSubcommand = 3
 	ctap_CLIENT_PIN_SUBCOMMAND_CHANGE_PIN        ctapClientPINSubcommand = 4
 	ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN     ctapClientPINSubcommand = 5
+	ctap_CLIENT_PIN_SUBCOMMAND_GET_UV_RETRIES    ctapClientPINSubcommand = 7
+
+	ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_UV_TOKEN_USING_UV_WITH_PERMISSIONS ctapClientPINSubcommand = 6
+	ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN_WITH_PERMISSIONS             ctapClientPINSubcommand = 9
 )
 
 var ctapClientPINSubcommandDescriptions = map[ctapClientPINSubcommand]string{
@@ -420,6 +974,56 @@ var ctapClientPINSubcommandDescriptions = map[ctapClientPINSubcommand]string{
 	ctap_CLIENT_PIN_SUBCOMMAND_SET_PIN:           "ctap_CLIENT_PIN_SUBCOMMAND_SET_PIN",
 	ctap_CLIENT_PIN_SUBCOMMAND_CHANGE_PIN:        "ctap_CLIENT_PIN_SUBCOMMAND_CHANGE_PIN",
 	ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN:     "ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN",
+	ctap_CLIENT_PIN_SUBCOMMAND_GET_UV_RETRIES:    "ctap_CLIENT_PIN_SUBCOMMAND_GET_UV_RETRIES",
+
+	ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_UV_TOKEN_USING_UV_WITH_PERMISSIONS: "ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_UV_TOKEN_USING_UV_WITH_PERMISSIONS",
+	ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN_WITH_PERMISSIONS:             "ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN_WITH_PERMISSIONS",
+}
+
+type ctapPINTokenPermission uint8
+
+const (
+	ctap_PIN_TOKEN_PERMISSION_MAKE_CREDENTIAL       ctapPINTokenPermission = 0x01
+	ctap_PIN_TOKEN_PERMISSION_GET_ASSERTION         ctapPINTokenPermission = 0x02
+	ctap_PIN_TOKEN_PERMISSION_CREDENTIAL_MANAGEMENT ctapPINTokenPermission = 0x04
+	ctap_PIN_TOKEN_PERMISSION_BIO_ENROLLMENT        ctapPINTokenPermission = 0x08
+	ctap_PIN_TOKEN_PERMISSION_LARGE_BLOB_WRITE      ctapPINTokenPermission = 0x10
+	ctap_PIN_TOKEN_PERMISSION_AUTHENTICATOR_CONFIG  ctapPINTokenPermission = 0x20
+)
+
+var ctapSupportedPINTokenPermissions = ctap_PIN_TOKEN_PERMISSION_MAKE_CREDENTIAL |
+	ctap_PIN_TOKEN_PERMISSION_GET_ASSERTION |
+	ctap_PIN_TOKEN_PERMISSION_CREDENTIAL_MANAGEMENT |
+	ctap_PIN_TOKEN_PERMISSION_LARGE_BLOB_WRITE |
+	ctap_PIN_TOKEN_PERMISSION_AUTHENTICATOR_CONFIG
+
+// Tokens from the legacy GET_PIN_TOKEN subcommand can't request permissions. Credential
+// management is included so that FIDO_2_1_PRE platforms can still manage credentials.
+var ctapLegacyPINTokenPermissions = ctap_PIN_TOKEN_PERMISSION_MAKE_CREDENTIAL |
+	ctap_PIN_TOKEN_PERMISSION_GET_ASSERTION |
+	ctap_PIN_TOKEN_PERMISSION_CREDENTIAL_MANAGEMENT
+
+const (
+	// A PIN token that is never used expires quickly
+	ctap_PIN_TOKEN_INITIAL_USAGE_PERIOD = 30 * time.Second
+	// Any PIN token expires after this long, even if in use
+	ctap_PIN_TOKEN_MAX_USAGE_PERIOD = 10 * time.Minute
+)
+
+type ctapPINTokenState struct {
+	permissions ctapPINTokenPermission
+	// The relying party the token is bound to, or empty if not yet bound
+	rpID     string
+	issuedAt time.Time
+	used     bool
+}
+
+func (state *ctapPINTokenState) expired() bool {
+	age := time.Since(state.issuedAt)
+	if !state.used && age > ctap_PIN_TOKEN_INITIAL_USAGE_PERIOD {
+		return true
+	}
+	return age > ctap_PIN_TOKEN_MAX_USAGE_PERIOD
 }
 
 type ctapClientPINArgs struct {
@@ -429,48 +1033,98 @@ type ctapClientPINArgs struct {
 	PINAuth         []byte                  `cbor:"4,keyasint,omitempty"`
 	NewPINEncoding  []byte                  `cbor:"5,keyasint,omitempty"`
 	PINHashEncoding []byte                  `cbor:"6,keyasint,omitempty"`
+	Permissions     ctapPINTokenPermission  `cbor:"9,keyasint,omitempty"`
+	RpID            string                  `cbor:"10,keyasint,omitempty"`
 }
 
 func (args ctapClientPINArgs) String() string {
-	return fmt.Sprintf("ctapClientPINArgs{PinProtocol: %d, SubCommand: %s, KeyAgreement: %v, PINAuth: %s, NewPINEncoding: %s, PINHashEncoding: %s}",
+	return fmt.Sprintf("ctapClientPINArgs{PinProtocol: %d, SubCommand: %s, KeyAgreement: %v, PINAuth: %s, NewPINEncoding: %s, PINHashEncoding: %s, Permissions: 0x%x, RpID: %s}",
 		args.PinProtocol,
 		ctapClientPINSubcommandDescriptions[args.SubCommand],
 		args.KeyAgreement,
 		hex.EncodeToString(args.PINAuth),
 		hex.EncodeToString(args.NewPINEncoding),
-		hex.EncodeToString(args.PINHashEncoding))
+		hex.EncodeToString(args.PINHashEncoding),
+		args.Permissions,
+		args.RpID)
 }
 
 type ctapClientPINResponse struct {
-	KeyAgreement *ctapCOSEPublicKey `cbor:"1,keyasint,omitempty"`
-	PinToken     []byte             `cbor:"2,keyasint,omitempty"`
-	Retries      *uint8             `cbor:"3,keyasint,omitempty"`
+	KeyAgreement    *ctapCOSEPublicKey `cbor:"1,keyasint,omitempty"`
+	PinToken        []byte             `cbor:"2,keyasint,omitempty"`
+	Retries         *uint8             `cbor:"3,keyasint,omitempty"`
+	PowerCycleState *bool              `cbor:"4,keyasint,omitempty"`
+	UVRetries       *uint8             `cbor:"5,keyasint,omitempty"`
 }
 
 func (args ctapClientPINResponse) String() string {
-	return fmt.Sprintf("ctapClientPINResponse{KeyAgreement: %s, PinToken: %s, Retries: %#v}",
+	return fmt.Sprintf("ctapClientPINResponse{KeyAgreement: %s, PinToken: %s, Retries: %#v, PowerCycleState: %#v, UVRetries: %#v}",
 		args.KeyAgreement,
 		hex.EncodeToString(args.PinToken),
-		args.Retries)
+		args.Retries,
+		args.PowerCycleState,
+		args.UVRetries)
 }
 
-func (server *ctapServer) getPINSharedSecret(remoteKey ctapCOSEPublicKey) []byte {
+func (server *ctapServer) getPINSharedSecret(protocol ctapPINProtocol, remoteKey ctapCOSEPublicKey) []byte {
 	pinKey := server.client.PINKeyAgreement()
-	return hashSHA256(pinKey.ECDH(bytesToBigInt(remoteKey.X), bytesToBigInt(remoteKey.Y)))
+	return protocol.deriveSharedSecret(pinKey.ECDH(bytesToBigInt(remoteKey.X), bytesToBigInt(remoteKey.Y)))
 }
 
-func (server *ctapServer) derivePINAuth(sharedSecret []byte, data []byte) []byte {
-	hash := hmac.New(sha256.New, sharedSecret)
-	hash.Write(data)
-	return hash.Sum(nil)[:16]
+// Checks that pinAuth authenticates the message with the current PIN token, and that the
+// token grants the permission. A non-empty rpID binds an unbound token to that relying party.
+func (server *ctapServer) verifyPINAuth(protocolID uint32, pinAuth []byte, message []byte, permission ctapPINTokenPermission, rpID string) ctapStatusCode {
+	if protocolID == 0 {
+		return ctap2_ERR_MISSING_PARAM
+	}
+	protocol, ok := ctapPINProtocols[protocolID]
+	if !ok {
+		return ctap1_ERR_INVALID_PARAMETER
+	}
+	state := server.pinTokenState
+	if state == nil || state.expired() {
+		ctapLogger.Printf("ERROR: PIN token is expired or was never issued\n\n")
+		server.pinTokenState = nil
+		return ctap2_ERR_PIN_AUTH_INVALID
+	}
+	if !ctapVerifyPINAuth(protocol, server.client.PINToken(), message, pinAuth) {
+		return ctap2_ERR_PIN_AUTH_INVALID
+	}
+	if state.permissions&permission == 0 {
+		ctapLogger.Printf("ERROR: PIN token lacks permission 0x%x\n\n", permission)
+		return ctap2_ERR_PIN_AUTH_INVALID
+	}
+	if rpID != "" {
+		if state.rpID == "" {
+			state.rpID = rpID
+		} else if state.rpID != rpID {
+			ctapLogger.Printf("ERROR: PIN token is bound to %s, not %s\n\n", state.rpID, rpID)
+			return ctap2_ERR_PIN_AUTH_INVALID
+		}
+	}
+	state.used = true
+	return ctap1_ERR_SUCCESS
+}
+
+func (server *ctapServer) decryptPINHash(protocol ctapPINProtocol, sharedSecret []byte, pinHashEncoding []byte) []byte {
+	pinHash, err := protocol.decrypt(sharedSecret, pinHashEncoding)
+	if err != nil || len(pinHash) < 16 {
+		return nil
+	}
+	return pinHash[:16]
 }
 
-func (server *ctapServer) decryptPINHash(sharedSecret []byte, pinHashEncoding []byte) []byte {
-	return decryptAESCBC(sharedSecret, pinHashEncoding)
+// Checks a new PIN against the configured minimum length, counted in Unicode code points
+func (server *ctapServer) meetsPINPolicy(pin []byte) bool {
+	minLength := int(server.client.AuthenticatorConfig().MinPINLength)
+	return utf8.RuneCount(pin) >= minLength && len(pin) <= ctap_MAX_PIN_LENGTH
 }
 
-func (server *ctapServer) decryptPIN(sharedSecret []byte, pinEncoding []byte) []byte {
-	decryptedPINPadded := decryptAESCBC(sharedSecret, pinEncoding)
+func (server *ctapServer) decryptPIN(protocol ctapPINProtocol, sharedSecret []byte, pinEncoding []byte) []byte {
+	decryptedPINPadded, err := protocol.decrypt(sharedSecret, pinEncoding)
+	if err != nil {
+		return nil
+	}
 	var decryptedPIN []byte = nil
 	for i := range decryptedPINPadded {
 		if decryptedPINPadded[i] == 0 {
@@ -483,15 +1137,25 @@ func (server *ctapServer) decryptPIN(sharedSecret []byte, pinEncoding []byte) []
 
 func (server *ctapServer) handleClientPIN(data []byte) []byte {
 	var args ctapClientPINArgs
-	err := cbor.Unmarshal(data, &args)
-	if err != nil {
-		ctapLogger.Printf("ERROR: %s", err)
-		return []byte{byte(ctap2_ERR_INVALID_CBOR)}
+	status := ctapDecodeRequest(data, &args)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
 	}
-	if args.PinProtocol != 1 {
+	ctapLogger.Printf("CTAP_CLIENT_PIN: %v\n\n", args)
+	if args.SubCommand == 0 {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	protocol, ok := ctapPINProtocols[args.PinProtocol]
+	// Retry counters can be read without agreeing on a protocol
+	if !ok && args.SubCommand != ctap_CLIENT_PIN_SUBCOMMAND_GET_RETRIES && args.SubCommand != ctap_CLIENT_PIN_SUBCOMMAND_GET_UV_RETRIES {
+		if args.PinProtocol == 0 {
+			return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+		}
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	if args.KeyAgreement != nil && !args.KeyAgreement.isValidECDHKey() {
 		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
 	}
-	ctapLogger.Printf("CTAP_CLIENT_PIN: %v\n\n", args)
 	var response []byte
 	switch args.SubCommand {
 	case ctap_CLIENT_PIN_SUBCOMMAND_GET_RETRIES:
@@ -499,22 +1163,48 @@ func (server *ctapServer) handleClientPIN(data []byte) []byte {
 	case ctap_CLIENT_PIN_SUBCOMMAND_GET_KEY_AGREEMENT:
 		response = server.handleGetKeyAgreement(args)
 	case ctap_CLIENT_PIN_SUBCOMMAND_SET_PIN:
-		response = server.handleSetPIN(args)
+		response = server.handleSetPIN(protocol, args)
 	case ctap_CLIENT_PIN_SUBCOMMAND_CHANGE_PIN:
-		response = server.handleChangePIN(args)
+		response = server.handleChangePIN(protocol, args)
 	case ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN:
-		response = server.handleGetPINToken(args)
+		response = server.handleGetPINToken(protocol, args, ctapLegacyPINTokenPermissions)
+	case ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_UV_TOKEN_USING_UV_WITH_PERMISSIONS:
+		status = checkPINTokenPermissions(args.Permissions)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+		response = server.handleGetPINUVTokenUsingUV(protocol, args)
+	case ctap_CLIENT_PIN_SUBCOMMAND_GET_UV_RETRIES:
+		response = server.handleGetUVRetries()
+	case ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN_WITH_PERMISSIONS:
+		status = checkPINTokenPermissions(args.Permissions)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+		response = server.handleGetPINToken(protocol, args, args.Permissions)
 	default:
-		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+		return []byte{byte(ctap2_ERR_INVALID_SUBCOMMAND)}
 	}
 	ctapLogger.Printf("CTAP_CLIENT_PIN RESPONSE: %#v\n\n", response)
 	return response
 }
 
+func checkPINTokenPermissions(permissions ctapPINTokenPermission) ctapStatusCode {
+	if permissions == 0 {
+		return ctap1_ERR_INVALID_PARAMETER
+	}
+	if permissions&^ctapSupportedPINTokenPermissions != 0 {
+		return ctap2_ERR_UNAUTHORIZED_PERM
+	}
+	return ctap1_ERR_SUCCESS
+}
+
 func (server *ctapServer) handleGetRetries() []byte {
 	retries := uint8(server.client.PINRetries())
+	powerCycleRequired := server.pinAuthBlocked()
 	response := ctapClientPINResponse{
-		Retries: &retries,
+		Retries:         &retries,
+		PowerCycleState: &powerCycleRequired,
 	}
 	ctapLogger.Printf("CTAP_CLIENT_PIN_GET_RETRIES: %v\n\n", response)
 	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
@@ -526,85 +1216,145 @@ func (server *ctapServer) handleGetKeyAgreement(args ctapClientPINArgs) []byte {
 		KeyAgreement: &ctapCOSEPublicKey{
 			KeyType:   int8(cose_KEY_TYPE_EC2),
 			Algorithm: int8(cose_ALGORITHM_ID_ECDH_HKDF_256),
-			X:         key.x.Bytes(),
-			Y:         key.y.Bytes(),
+			Curve:     int8(cose_CURVE_ID_P256),
+			X:         key.x.FillBytes(make([]byte, 32)),
+			Y:         key.y.FillBytes(make([]byte, 32)),
 		},
 	}
 	ctapLogger.Printf("CLIENT_PIN_GET_KEY_AGREEMENT RESPONSE: %#v\n\n", response)
 	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
 }
 
-func (server *ctapServer) handleSetPIN(args ctapClientPINArgs) []byte {
+func (server *ctapServer) handleSetPIN(protocol ctapPINProtocol, args ctapClientPINArgs) []byte {
 	if server.client.PINHash() != nil {
 		return []byte{byte(ctap2_ERR_PIN_AUTH_INVALID)}
 	}
 	if args.KeyAgreement == nil || args.PINAuth == nil || args.NewPINEncoding == nil {
 		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	pinAuth := server.derivePINAuth(sharedSecret, args.NewPINEncoding)
-	if !bytes.Equal(pinAuth, args.PINAuth) {
+	sharedSecret := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	if !ctapVerifyPINAuth(protocol, sharedSecret, args.NewPINEncoding, args.PINAuth) {
 		return []byte{byte(ctap2_ERR_PIN_AUTH_INVALID)}
 	}
-	decryptedPIN := server.decryptPIN(sharedSecret, args.NewPINEncoding)
-	if len(decryptedPIN) < 4 {
+	decryptedPIN := server.decryptPIN(protocol, sharedSecret, args.NewPINEncoding)
+	if !server.meetsPINPolicy(decryptedPIN) {
 		return []byte{byte(ctap2_ERR_PIN_POLICY_VIOLATION)}
 	}
 	pinHash := hashSHA256(decryptedPIN)[:16]
-	server.client.SetPINRetries(8)
+	config := server.client.AuthenticatorConfig()
+	config.PINCodePointLength = uint32(utf8.RuneCount(decryptedPIN))
+	server.client.SetAuthenticatorConfig(config)
+	server.client.SetPINRetries(ctap_MAX_PIN_RETRIES)
 	server.client.SetPINHash(pinHash)
+	server.resetPINToken()
 	ctapLogger.Printf("SETTING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
 	return []byte{byte(ctap1_ERR_SUCCESS)}
 }
 
-func (server *ctapServer) handleChangePIN(args ctapClientPINArgs) []byte {
-	if args.KeyAgreement == nil || args.PINAuth == nil {
+func (server *ctapServer) handleChangePIN(protocol ctapPINProtocol, args ctapClientPINArgs) []byte {
+	if args.KeyAgreement == nil || args.PINAuth == nil || args.NewPINEncoding == nil || args.PINHashEncoding == nil {
 		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
 	}
-	if server.client.PINRetries() == 0 {
+	if server.client.PINHash() == nil {
+		return []byte{byte(ctap2_ERR_NO_PIN_SET)}
+	}
+	if server.client.PINRetries() <= 0 {
 		return []byte{byte(ctap2_ERR_PIN_BLOCKED)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	pinAuth := server.derivePINAuth(sharedSecret, append(args.NewPINEncoding, args.PINHashEncoding...))
-	if !bytes.Equal(pinAuth, args.PINAuth) {
+	sharedSecret := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	if !ctapVerifyPINAuth(protocol, sharedSecret, append(args.NewPINEncoding, args.PINHashEncoding...), args.PINAuth) {
 		return []byte{byte(ctap2_ERR_PIN_AUTH_INVALID)}
 	}
-	server.client.SetPINRetries(server.client.PINRetries() - 1)
-	decryptedPINHash := decryptAESCBC(sharedSecret, args.PINHashEncoding)
-	if !bytes.Equal(server.client.PINHash(), decryptedPINHash) {
-		// TODO: Mismatch detected, handle it
-		return []byte{byte(ctap2_ERR_PIN_INVALID)}
+	status := server.verifyPINHash(protocol, sharedSecret, args.PINHashEncoding)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
 	}
-	server.client.SetPINRetries(8)
-	newPIN := server.decryptPIN(sharedSecret, args.NewPINEncoding)
-	if len(newPIN) < 4 {
+	newPIN := server.decryptPIN(protocol, sharedSecret, args.NewPINEncoding)
+	if !server.meetsPINPolicy(newPIN) {
 		return []byte{byte(ctap2_ERR_PIN_POLICY_VIOLATION)}
 	}
 	pinHash := hashSHA256(newPIN)[:16]
+	config := server.client.AuthenticatorConfig()
+	if config.ForcePINChange {
+		if bytes.Equal(pinHash, server.client.PINHash()) {
+			return []byte{byte(ctap2_ERR_PIN_POLICY_VIOLATION)}
+		}
+		config.ForcePINChange = false
+	}
+	config.PINCodePointLength = uint32(utf8.RuneCount(newPIN))
+	server.client.SetAuthenticatorConfig(config)
 	server.client.SetPINHash(pinHash)
+	server.resetPINToken()
 	return []byte{byte(ctap1_ERR_SUCCESS)}
 }
 
-func (server *ctapServer) handleGetPINToken(args ctapClientPINArgs) []byte {
-	if args.PINHashEncoding == nil || args.KeyAgreement.X == nil {
+func (server *ctapServer) handleGetPINToken(protocol ctapPINProtocol, args ctapClientPINArgs, permissions ctapPINTokenPermission) []byte {
+	if args.PINHashEncoding == nil || args.KeyAgreement == nil || args.KeyAgreement.X == nil {
 		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
 	}
+	if server.client.PINHash() == nil {
+		return []byte{byte(ctap2_ERR_NO_PIN_SET)}
+	}
 	if server.client.PINRetries() <= 0 {
 		return []byte{byte(ctap2_ERR_PIN_BLOCKED)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	server.client.SetPINRetries(server.client.PINRetries() - 1)
-	pinHash := server.decryptPINHash(sharedSecret, args.PINHashEncoding)
+	sharedSecret := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	status := server.verifyPINHash(protocol, sharedSecret, args.PINHashEncoding)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
+	// Entering the PIN unblocks built-in user verification
+	server.resetUVRetries()
+	if server.client.AuthenticatorConfig().ForcePINChange {
+		return []byte{byte(ctap2_ERR_PIN_POLICY_VIOLATION)}
+	}
+	return server.issuePINToken(protocol, sharedSecret, permissions, args.RpID)
+}
+
+// Checks the PIN hash sent by the platform, using up a retry unless it matches. Each wrong PIN
+// changes the key agreement key, and too many in a row block PIN entry until a power cycle.
+func (server *ctapServer) verifyPINHash(protocol ctapPINProtocol, sharedSecret []byte, pinHashEncoding []byte) ctapStatusCode {
+	if server.pinAuthBlocked() {
+		return ctap2_ERR_PIN_AUTH_BLOCKED
+	}
+	retries := server.client.PINRetries() - 1
+	server.client.SetPINRetries(retries)
+	pinHash := server.decryptPINHash(protocol, sharedSecret, pinHashEncoding)
 	ctapLogger.Printf("TRYING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
-	if !bytes.Equal(pinHash, server.client.PINHash()) {
-		// TODO: Handle mismatch here by regening the key agreement key
+	if pinHash == nil || !hmac.Equal(pinHash, server.client.PINHash()) {
 		ctapLogger.Printf("MISMATCH: Provided PIN %v doesn't match stored PIN %v\n\n", hex.EncodeToString(pinHash), hex.EncodeToString(server.client.PINHash()))
-		return []byte{byte(ctap2_ERR_PIN_INVALID)}
+		server.client.RegeneratePINKeyAgreement()
+		authBlocked := server.recordPINFailure()
+		if retries <= 0 {
+			return ctap2_ERR_PIN_BLOCKED
+		}
+		if authBlocked {
+			return ctap2_ERR_PIN_AUTH_BLOCKED
+		}
+		return ctap2_ERR_PIN_INVALID
+	}
+	server.clearPINFailures()
+	server.client.SetPINRetries(ctap_MAX_PIN_RETRIES)
+	return ctap1_ERR_SUCCESS
+}
+
+// Tokens issued before the PIN was set or changed must stop working along with their permissions
+func (server *ctapServer) resetPINToken() {
+	server.client.RegeneratePINToken()
+	server.pinTokenState = nil
+}
+
+func (server *ctapServer) issuePINToken(protocol ctapPINProtocol, sharedSecret []byte, permissions ctapPINTokenPermission, rpID string) []byte {
+	// Handing out a new token invalidates any previous one
+	server.client.RegeneratePINToken()
+	server.pinTokenState = &ctapPINTokenState{
+		permissions: permissions,
+		rpID:        rpID,
+		issuedAt:    time.Now(),
 	}
-	server.client.SetPINRetries(8)
 	response := ctapClientPINResponse{
-		PinToken: encryptAESCBC(sharedSecret, server.client.PINToken()),
+		PinToken: protocol.encrypt(sharedSecret, server.client.PINToken()),
 	}
-	ctapLogger.Printf("GET_PIN_TOKEN RESPONSE: %#v\n\n",response)
+	ctapLogger.Printf("GET_PIN_TOKEN RESPONSE: %#v\n\n", response)
 	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
 }
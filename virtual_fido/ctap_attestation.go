@@ -0,0 +1,111 @@
+package virtual_fido
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+)
+
+type ctapEnterpriseAttestation uint32
+
+const (
+	// Enterprise attestation for relying parties preconfigured on the authenticator
+	ctap_ENTERPRISE_ATTESTATION_VENDOR_FACILITATED ctapEnterpriseAttestation = 1
+	// Enterprise attestation for any relying party the platform allows
+	ctap_ENTERPRISE_ATTESTATION_PLATFORM_MANAGED ctapEnterpriseAttestation = 2
+)
+
+type ctapFIDOU2FAttestationStatement struct {
+	Sig []byte   `cbor:"sig"`
+	X5c [][]byte `cbor:"x5c"`
+}
+
+func (server *ctapServer) attestationFormatNames() []string {
+	names := make([]string, 0)
+	for _, format := range server.client.AttestationFormats() {
+		names = append(names, string(format))
+	}
+	return names
+}
+
+// Picks the attestation format for a new credential: the platform's most preferred format
+// that the client allows, or else the client's own preference
+func (server *ctapServer) negotiateAttestationFormat(preference []string, credentialSource *CredentialSource) AttestationFormat {
+	allowed := make([]AttestationFormat, 0)
+	for _, format := range server.client.AttestationFormats() {
+		if format == AttestationFormatFIDOU2F {
+			// fido-u2f can only describe P-256 credentials
+			key, ok := credentialSource.PrivateKey.(*ecdsa.PrivateKey)
+			if !ok || key.Curve != elliptic.P256() {
+				continue
+			}
+		}
+		allowed = append(allowed, format)
+	}
+	if len(allowed) == 0 {
+		return AttestationFormatNone
+	}
+	for _, preferred := range preference {
+		for _, format := range allowed {
+			if string(format) == preferred {
+				return format
+			}
+		}
+	}
+	return allowed[0]
+}
+
+func (server *ctapServer) enterpriseAttestationApplies(mode ctapEnterpriseAttestation, rpID string) bool {
+	switch mode {
+	case ctap_ENTERPRISE_ATTESTATION_PLATFORM_MANAGED:
+		return true
+	case ctap_ENTERPRISE_ATTESTATION_VENDOR_FACILITATED:
+		for _, enterpriseRPID := range server.client.EnterpriseAttestationRPIDs() {
+			if enterpriseRPID == rpID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Builds a packed attestation statement whose certificate identifies this device
+func (server *ctapServer) makeEnterpriseAttestation(authData []byte, clientDataHash []byte) (string, interface{}) {
+	attestationKey, certificateChain := server.client.EnterpriseAttestationKey()
+	return string(AttestationFormatPacked), ctapBasicAttestationStatement{
+		Alg: cose_ALGORITHM_ID_ES256,
+		Sig: sign(attestationKey, flatten([][]byte{authData, clientDataHash})),
+		X5c: certificateChain,
+	}
+}
+
+// Builds the attestation statement for a new credential, returning its format identifier
+func (server *ctapServer) makeAttestation(credentialSource *CredentialSource, algorithm coseAlgorithmID, authData []byte, clientDataHash []byte, preference []string) (string, interface{}) {
+	format := server.negotiateAttestationFormat(preference, credentialSource)
+	switch format {
+	case AttestationFormatNone:
+		return string(format), map[string]interface{}{}
+	case AttestationFormatFIDOU2F:
+		// Mirrors U2F registration, where each key is certified by the attestation CA
+		privateKey := credentialSource.PrivateKey.(*ecdsa.PrivateKey)
+		publicKey := elliptic.Marshal(elliptic.P256(), privateKey.X, privateKey.Y)
+		rpIDHash := authData[:32]
+		signedData := flatten([][]byte{{0}, rpIDHash, clientDataHash, credentialSource.ID, publicKey})
+		return string(format), ctapFIDOU2FAttestationStatement{
+			Sig: sign(privateKey, signedData),
+			X5c: [][]byte{server.client.CreateAttestationCertificiate(privateKey)},
+		}
+	}
+	signedData := flatten([][]byte{authData, clientDataHash})
+	if server.client.AttestationType() == AttestationTypeSelf {
+		return string(format), ctapSelfAttestationStatement{
+			Alg: algorithm,
+			Sig: sign(credentialSource.PrivateKey, signedData),
+		}
+	}
+	attestationKey, certificateChain := server.client.AttestationKey()
+	return string(format), ctapBasicAttestationStatement{
+		Alg: cose_ALGORITHM_ID_ES256,
+		Sig: sign(attestationKey, signedData),
+		X5c: certificateChain,
+	}
+}
@@ -0,0 +1,121 @@
+package virtual_fido
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	ctap_DEFAULT_MIN_PIN_LENGTH uint32 = 4
+	ctap_MAX_PIN_LENGTH         int    = 63
+	// Maximum number of relying parties allowed to read the minimum PIN length
+	ctap_MAX_MIN_PIN_LENGTH_RPIDS int = 8
+)
+
+type ctapConfigSubcommand uint32
+
+const (
+	ctap_CONFIG_SUBCOMMAND_ENABLE_ENTERPRISE_ATTESTATION ctapConfigSubcommand = 0x01
+	ctap_CONFIG_SUBCOMMAND_TOGGLE_ALWAYS_UV              ctapConfigSubcommand = 0x02
+	ctap_CONFIG_SUBCOMMAND_SET_MIN_PIN_LENGTH            ctapConfigSubcommand = 0x03
+)
+
+var ctapConfigSubcommandDescriptions = map[ctapConfigSubcommand]string{
+	ctap_CONFIG_SUBCOMMAND_ENABLE_ENTERPRISE_ATTESTATION: "ctap_CONFIG_SUBCOMMAND_ENABLE_ENTERPRISE_ATTESTATION",
+	ctap_CONFIG_SUBCOMMAND_TOGGLE_ALWAYS_UV:              "ctap_CONFIG_SUBCOMMAND_TOGGLE_ALWAYS_UV",
+	ctap_CONFIG_SUBCOMMAND_SET_MIN_PIN_LENGTH:            "ctap_CONFIG_SUBCOMMAND_SET_MIN_PIN_LENGTH",
+}
+
+type ctapConfigArgs struct {
+	SubCommand       ctapConfigSubcommand `cbor:"1,keyasint"`
+	SubCommandParams cbor.RawMessage      `cbor:"2,keyasint,omitempty"`
+	PinProtocol      uint32               `cbor:"3,keyasint,omitempty"`
+	PinAuth          []byte               `cbor:"4,keyasint,omitempty"`
+}
+
+func (args ctapConfigArgs) String() string {
+	return fmt.Sprintf("ctapConfigArgs{SubCommand: %s, SubCommandParams: %s, PinProtocol: %d, PinAuth: %s}",
+		ctapConfigSubcommandDescriptions[args.SubCommand],
+		hex.EncodeToString(args.SubCommandParams),
+		args.PinProtocol,
+		hex.EncodeToString(args.PinAuth))
+}
+
+type ctapSetMinPINLengthParams struct {
+	NewMinPINLength   uint32   `cbor:"1,keyasint,omitempty"`
+	MinPINLengthRPIDs []string `cbor:"2,keyasint,omitempty"`
+	ForceChangePIN    bool     `cbor:"3,keyasint,omitempty"`
+}
+
+func (server *ctapServer) handleConfig(data []byte) []byte {
+	var args ctapConfigArgs
+	status := ctapDecodeRequest(data, &args)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
+	ctapLogger.Printf("AUTHENTICATOR CONFIG: %v\n\n", args)
+	if _, ok := ctapConfigSubcommandDescriptions[args.SubCommand]; !ok {
+		return []byte{byte(ctap2_ERR_INVALID_SUBCOMMAND)}
+	}
+	if server.client.PINHash() != nil || server.client.AuthenticatorConfig().AlwaysUV {
+		if args.PinAuth == nil {
+			return []byte{byte(ctap2_ERR_PIN_REQUIRED)}
+		}
+		message := flatten([][]byte{bytes.Repeat([]byte{0xff}, 32), {byte(ctap_COMMAND_AUTHENTICATOR_CONFIG), byte(args.SubCommand)}, args.SubCommandParams})
+		status = server.verifyPINAuth(args.PinProtocol, args.PinAuth, message, ctap_PIN_TOKEN_PERMISSION_AUTHENTICATOR_CONFIG, "")
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+	}
+	config := server.client.AuthenticatorConfig()
+	switch args.SubCommand {
+	case ctap_CONFIG_SUBCOMMAND_ENABLE_ENTERPRISE_ATTESTATION:
+		config.EnterpriseAttestation = true
+	case ctap_CONFIG_SUBCOMMAND_TOGGLE_ALWAYS_UV:
+		config.AlwaysUV = !config.AlwaysUV
+	case ctap_CONFIG_SUBCOMMAND_SET_MIN_PIN_LENGTH:
+		var params ctapSetMinPINLengthParams
+		status = ctapDecodeRequest(args.SubCommandParams, &params)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+		status = server.setMinPINLength(&config, params)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+	}
+	server.client.SetAuthenticatorConfig(config)
+	return []byte{byte(ctap1_ERR_SUCCESS)}
+}
+
+func (server *ctapServer) setMinPINLength(config *AuthenticatorConfig, params ctapSetMinPINLengthParams) ctapStatusCode {
+	newMinPINLength := params.NewMinPINLength
+	if newMinPINLength == 0 {
+		newMinPINLength = config.MinPINLength
+	}
+	if newMinPINLength < config.MinPINLength || int(newMinPINLength) > ctap_MAX_PIN_LENGTH {
+		return ctap2_ERR_PIN_POLICY_VIOLATION
+	}
+	if len(params.MinPINLengthRPIDs) > ctap_MAX_MIN_PIN_LENGTH_RPIDS {
+		return ctap2_ERR_PIN_POLICY_VIOLATION
+	}
+	if params.ForceChangePIN && server.client.PINHash() == nil {
+		return ctap2_ERR_NO_PIN_SET
+	}
+	if server.client.PINHash() != nil && config.PINCodePointLength < newMinPINLength {
+		// The current PIN is too short now. PINs set before their length was
+		// recorded have a length of 0, so they must be changed as well.
+		config.ForcePINChange = true
+	}
+	if params.ForceChangePIN {
+		config.ForcePINChange = true
+	}
+	config.MinPINLength = newMinPINLength
+	if params.MinPINLengthRPIDs != nil {
+		config.MinPINLengthRPIDs = params.MinPINLengthRPIDs
+	}
+	return ctap1_ERR_SUCCESS
+}
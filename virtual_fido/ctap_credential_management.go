@@ -0,0 +1,289 @@
+package virtual_fido
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Resident credentials the device stores before MAKE_CREDENTIAL reports a full key store
+const ctap_MAX_RESIDENT_CREDENTIALS int = 100
+
+type ctapCredentialManagementSubcommand uint32
+
+const (
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_GET_CREDS_METADATA             ctapCredentialManagementSubcommand = 0x01
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_BEGIN            ctapCredentialManagementSubcommand = 0x02
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_GET_NEXT_RP      ctapCredentialManagementSubcommand = 0x03
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_BEGIN    ctapCredentialManagementSubcommand = 0x04
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_GET_NEXT ctapCredentialManagementSubcommand = 0x05
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_DELETE_CREDENTIAL              ctapCredentialManagementSubcommand = 0x06
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_UPDATE_USER_INFORMATION        ctapCredentialManagementSubcommand = 0x07
+)
+
+var ctapCredentialManagementSubcommandDescriptions = map[ctapCredentialManagementSubcommand]string{
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_GET_CREDS_METADATA:             "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_GET_CREDS_METADATA",
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_BEGIN:            "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_BEGIN",
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_GET_NEXT_RP:      "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_GET_NEXT_RP",
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_BEGIN:    "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_BEGIN",
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_GET_NEXT: "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_GET_NEXT",
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_DELETE_CREDENTIAL:              "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_DELETE_CREDENTIAL",
+	ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_UPDATE_USER_INFORMATION:        "ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_UPDATE_USER_INFORMATION",
+}
+
+type ctapCredentialManagementArgs struct {
+	SubCommand       ctapCredentialManagementSubcommand `cbor:"1,keyasint"`
+	SubCommandParams cbor.RawMessage                    `cbor:"2,keyasint,omitempty"`
+	PinProtocol      uint32                             `cbor:"3,keyasint,omitempty"`
+	PinAuth          []byte                             `cbor:"4,keyasint,omitempty"`
+}
+
+func (args ctapCredentialManagementArgs) String() string {
+	return fmt.Sprintf("ctapCredentialManagementArgs{SubCommand: %s, SubCommandParams: %s, PinProtocol: %d, PinAuth: %s}",
+		ctapCredentialManagementSubcommandDescriptions[args.SubCommand],
+		hex.EncodeToString(args.SubCommandParams),
+		args.PinProtocol,
+		hex.EncodeToString(args.PinAuth))
+}
+
+type ctapCredentialManagementParams struct {
+	RpIDHash     []byte                          `cbor:"1,keyasint,omitempty"`
+	CredentialID *PublicKeyCredentialDescriptor  `cbor:"2,keyasint,omitempty"`
+	User         *PublicKeyCrendentialUserEntity `cbor:"3,keyasint,omitempty"`
+}
+
+type ctapCredentialsMetadataResponse struct {
+	ExistingResidentCredentialsCount             uint32 `cbor:"1,keyasint"`
+	MaxPossibleRemainingResidentCredentialsCount uint32 `cbor:"2,keyasint"`
+}
+
+type ctapCredentialManagementResponse struct {
+	Rp               *PublicKeyCredentialRpEntity    `cbor:"3,keyasint,omitempty"`
+	RpIDHash         []byte                          `cbor:"4,keyasint,omitempty"`
+	TotalRPs         uint32                          `cbor:"5,keyasint,omitempty"`
+	User             *PublicKeyCrendentialUserEntity `cbor:"6,keyasint,omitempty"`
+	CredentialID     *PublicKeyCredentialDescriptor  `cbor:"7,keyasint,omitempty"`
+	PublicKey        cbor.RawMessage                 `cbor:"8,keyasint,omitempty"`
+	TotalCredentials uint32                          `cbor:"9,keyasint,omitempty"`
+	CredProtect      uint8                           `cbor:"10,keyasint,omitempty"`
+}
+
+func (server *ctapServer) handleCredentialManagement(data []byte) []byte {
+	var args ctapCredentialManagementArgs
+	status := ctapDecodeRequest(data, &args)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
+	ctapLogger.Printf("CREDENTIAL MANAGEMENT: %v\n\n", args)
+	var params ctapCredentialManagementParams
+	status = ctapDecodeRequest(args.SubCommandParams, &params)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
+	switch args.SubCommand {
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_GET_CREDS_METADATA,
+		ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_BEGIN,
+		ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_BEGIN,
+		ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_DELETE_CREDENTIAL,
+		ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_UPDATE_USER_INFORMATION:
+		status = server.verifyCredentialManagementPINAuth(args, params)
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+	}
+	var response []byte
+	switch args.SubCommand {
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_GET_CREDS_METADATA:
+		response = server.handleGetCredsMetadata()
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_BEGIN:
+		response = server.handleEnumerateRPsBegin()
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_RPS_GET_NEXT_RP:
+		response = server.handleEnumerateRPsGetNextRP()
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_BEGIN:
+		response = server.handleEnumerateCredentialsBegin(params)
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_GET_NEXT:
+		response = server.handleEnumerateCredentialsGetNextCredential()
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_DELETE_CREDENTIAL:
+		response = server.handleDeleteCredential(params)
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_UPDATE_USER_INFORMATION:
+		response = server.handleUpdateUserInformation(params)
+	default:
+		return []byte{byte(ctap2_ERR_INVALID_SUBCOMMAND)}
+	}
+	ctapLogger.Printf("CREDENTIAL MANAGEMENT RESPONSE: %#v\n\n", response)
+	return response
+}
+
+func (server *ctapServer) verifyCredentialManagementPINAuth(args ctapCredentialManagementArgs, params ctapCredentialManagementParams) ctapStatusCode {
+	if args.PinAuth == nil {
+		return ctap2_ERR_PIN_REQUIRED
+	}
+	message := append([]byte{byte(args.SubCommand)}, args.SubCommandParams...)
+	status := server.verifyPINAuth(args.PinProtocol, args.PinAuth, message, ctap_PIN_TOKEN_PERMISSION_CREDENTIAL_MANAGEMENT, "")
+	if status != ctap1_ERR_SUCCESS {
+		return status
+	}
+	boundRPID := server.pinTokenState.rpID
+	if boundRPID == "" {
+		return ctap1_ERR_SUCCESS
+	}
+	// A token bound to a relying party can only manage that relying party's credentials
+	switch args.SubCommand {
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_ENUMERATE_CREDENTIALS_BEGIN:
+		rpIDHash := sha256.Sum256([]byte(boundRPID))
+		if !bytes.Equal(rpIDHash[:], params.RpIDHash) {
+			return ctap2_ERR_PIN_AUTH_INVALID
+		}
+	case ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_DELETE_CREDENTIAL,
+		ctap_CREDENTIAL_MANAGEMENT_SUBCOMMAND_UPDATE_USER_INFORMATION:
+		if params.CredentialID != nil {
+			source := server.findIdentity(params.CredentialID.Id)
+			if source != nil && source.RelyingParty.Id != boundRPID {
+				return ctap2_ERR_PIN_AUTH_INVALID
+			}
+		}
+	default:
+		return ctap2_ERR_PIN_AUTH_INVALID
+	}
+	return ctap1_ERR_SUCCESS
+}
+
+func (server *ctapServer) findIdentity(id []byte) *CredentialSource {
+	for _, identity := range server.client.Identities() {
+		if bytes.Equal(identity.ID, id) {
+			return &identity
+		}
+	}
+	return nil
+}
+
+func (server *ctapServer) findUserIdentity(rpID string, userID []byte) *CredentialSource {
+	for _, identity := range server.client.Identities() {
+		if identity.RelyingParty.Id == rpID && bytes.Equal(identity.User.Id, userID) {
+			return &identity
+		}
+	}
+	return nil
+}
+
+func (server *ctapServer) remainingResidentCredentials() uint32 {
+	remaining := ctap_MAX_RESIDENT_CREDENTIALS - len(server.client.Identities())
+	if remaining < 0 {
+		return 0
+	}
+	return uint32(remaining)
+}
+
+func (server *ctapServer) handleGetCredsMetadata() []byte {
+	response := ctapCredentialsMetadataResponse{
+		ExistingResidentCredentialsCount:             uint32(len(server.client.Identities())),
+		MaxPossibleRemainingResidentCredentialsCount: server.remainingResidentCredentials(),
+	}
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) handleEnumerateRPsBegin() []byte {
+	relyingParties := make([]PublicKeyCredentialRpEntity, 0)
+	seen := make(map[string]bool)
+	for _, source := range server.client.Identities() {
+		if !seen[source.RelyingParty.Id] {
+			seen[source.RelyingParty.Id] = true
+			relyingParties = append(relyingParties, source.RelyingParty)
+		}
+	}
+	if len(relyingParties) == 0 {
+		server.rpEnumeration = nil
+		return []byte{byte(ctap2_ERR_NO_CREDENTIALS)}
+	}
+	server.rpEnumeration = relyingParties
+	response := server.nextRPResponse()
+	response.TotalRPs = uint32(len(relyingParties))
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) handleEnumerateRPsGetNextRP() []byte {
+	if len(server.rpEnumeration) == 0 {
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	response := server.nextRPResponse()
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) nextRPResponse() ctapCredentialManagementResponse {
+	rp := server.rpEnumeration[0]
+	server.rpEnumeration = server.rpEnumeration[1:]
+	rpIDHash := sha256.Sum256([]byte(rp.Id))
+	return ctapCredentialManagementResponse{
+		Rp:       &rp,
+		RpIDHash: rpIDHash[:],
+	}
+}
+
+func (server *ctapServer) handleEnumerateCredentialsBegin(params ctapCredentialManagementParams) []byte {
+	if params.RpIDHash == nil {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	sources := make([]CredentialSource, 0)
+	for _, source := range server.client.Identities() {
+		rpIDHash := sha256.Sum256([]byte(source.RelyingParty.Id))
+		if bytes.Equal(rpIDHash[:], params.RpIDHash) {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		server.credentialEnumeration = nil
+		return []byte{byte(ctap2_ERR_NO_CREDENTIALS)}
+	}
+	server.credentialEnumeration = sources
+	response := server.nextCredentialResponse()
+	response.TotalCredentials = uint32(len(sources))
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) handleEnumerateCredentialsGetNextCredential() []byte {
+	if len(server.credentialEnumeration) == 0 {
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	response := server.nextCredentialResponse()
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) nextCredentialResponse() ctapCredentialManagementResponse {
+	source := server.credentialEnumeration[0]
+	server.credentialEnumeration = server.credentialEnumeration[1:]
+	descriptor := source.ctapDescriptor()
+	return ctapCredentialManagementResponse{
+		User:         &source.User,
+		CredentialID: &descriptor,
+		PublicKey:    ctapEncodeKeyAsCOSE(source.PrivateKey.Public()),
+		CredProtect:  uint8(source.CredProtect),
+	}
+}
+
+func (server *ctapServer) handleDeleteCredential(params ctapCredentialManagementParams) []byte {
+	if params.CredentialID == nil {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	if !server.client.DeleteIdentity(params.CredentialID.Id) {
+		return []byte{byte(ctap2_ERR_NO_CREDENTIALS)}
+	}
+	return []byte{byte(ctap1_ERR_SUCCESS)}
+}
+
+func (server *ctapServer) handleUpdateUserInformation(params ctapCredentialManagementParams) []byte {
+	if params.CredentialID == nil || params.User == nil {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	source := server.findIdentity(params.CredentialID.Id)
+	if source == nil {
+		return []byte{byte(ctap2_ERR_NO_CREDENTIALS)}
+	}
+	if !bytes.Equal(source.User.Id, params.User.Id) {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	server.client.UpdateIdentityUser(source.ID, *params.User)
+	return []byte{byte(ctap1_ERR_SUCCESS)}
+}
@@ -0,0 +1,140 @@
+package virtual_fido
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Room left in a request for everything other than an allow or exclude list
+const ctap_MAX_REQUEST_PARAMETERS_SIZE int = 400
+
+// Encoded size of a credential descriptor, not counting the credential ID
+const ctap_CREDENTIAL_DESCRIPTOR_OVERHEAD int = 24
+
+type ctapGetInfoOptions struct {
+	IsPlatform                  bool `cbor:"plat"`
+	CanResidentKey              bool `cbor:"rk"`
+	HasClientPIN                bool `cbor:"clientPin"`
+	CanUserPresence             bool `cbor:"up"`
+	CanUserVerification         bool `cbor:"uv,omitempty"`
+	HasPINUVAuthToken           bool `cbor:"pinUvAuthToken"`
+	HasUVToken                  bool `cbor:"uvToken,omitempty"`
+	CredentialManagement        bool `cbor:"credMgmt"`
+	CredentialManagementPreview bool `cbor:"credentialMgmtPreview"`
+	LargeBlobs                  bool `cbor:"largeBlobs"`
+	AuthenticatorConfig         bool `cbor:"authnrCfg"`
+	AlwaysUV                    bool `cbor:"alwaysUv"`
+	SetMinPINLength             bool `cbor:"setMinPINLength"`
+	EnterpriseAttestation       bool `cbor:"ep"`
+	MakeCredUVNotRequired       bool `cbor:"makeCredUvNotRqd"`
+}
+
+type ctapGetInfoResponse struct {
+	Versions                         []string                    `cbor:"1,keyasint,omitempty"`
+	Extensions                       []string                    `cbor:"2,keyasint,omitempty"`
+	AAGUID                           [16]byte                    `cbor:"3,keyasint,omitempty"`
+	Options                          ctapGetInfoOptions          `cbor:"4,keyasint,omitempty"`
+	MaxMessageSize                   uint32                      `cbor:"5,keyasint,omitempty"`
+	PinProtocols                     []uint32                    `cbor:"6,keyasint,omitempty"`
+	MaxCredentialCountInList         uint32                      `cbor:"7,keyasint,omitempty"`
+	MaxCredentialIDLength            uint32                      `cbor:"8,keyasint,omitempty"`
+	Transports                       []string                    `cbor:"9,keyasint,omitempty"`
+	Algorithms                       []PublicKeyCredentialParams `cbor:"10,keyasint,omitempty"`
+	MaxSerializedLargeBlobArray      uint32                      `cbor:"11,keyasint,omitempty"`
+	ForcePINChange                   bool                        `cbor:"12,keyasint,omitempty"`
+	MinPINLength                     uint32                      `cbor:"13,keyasint,omitempty"`
+	FirmwareVersion                  uint32                      `cbor:"14,keyasint,omitempty"`
+	MaxCredBlobLength                uint32                      `cbor:"15,keyasint,omitempty"`
+	MaxRPIDsForSetMinPINLength       uint32                      `cbor:"16,keyasint,omitempty"`
+	RemainingDiscoverableCredentials *uint32                     `cbor:"20,keyasint,omitempty"`
+	AttestationFormats               []string                    `cbor:"22,keyasint,omitempty"`
+}
+
+// The identifiers of the extensions that the MAKE_CREDENTIAL and GET_ASSERTION handlers decode
+func ctapSupportedExtensions() []string {
+	extensions := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, inputs := range []interface{}{ctapMakeCredentialExtensions{}, ctapGetAssertionExtensions{}} {
+		inputsType := reflect.TypeOf(inputs)
+		for i := 0; i < inputsType.NumField(); i++ {
+			identifier := strings.Split(inputsType.Field(i).Tag.Get("cbor"), ",")[0]
+			if !seen[identifier] {
+				seen[identifier] = true
+				extensions = append(extensions, identifier)
+			}
+		}
+	}
+	return extensions
+}
+
+// Credentials wrapped in their ID have the longest IDs. Their length depends on the key and on
+// the extension data stored with them, so measure the largest credential for each algorithm.
+func (server *ctapServer) credentialIDLength() int {
+	if server.maxCredentialIDLength != 0 {
+		return server.maxCredentialIDLength
+	}
+	for _, algorithm := range ctapSupportedAlgorithms {
+		options := CredentialOptions{
+			Algorithm:   algorithm,
+			HMACSecret:  true,
+			CredProtect: CredentialProtectionUVRequired,
+			CredBlob:    make([]byte, ctap_MAX_CRED_BLOB_LENGTH),
+		}
+		source := newCredentialSource(PublicKeyCredentialRpEntity{}, PublicKeyCrendentialUserEntity{}, options)
+		length := len(server.wrapCredential(source))
+		if length > server.maxCredentialIDLength {
+			server.maxCredentialIDLength = length
+		}
+	}
+	return server.maxCredentialIDLength
+}
+
+func (server *ctapServer) handleGetInfo(data []byte) []byte {
+	config := server.client.AuthenticatorConfig()
+	versions := []string{"FIDO_2_0", "FIDO_2_1_PRE", "FIDO_2_1"}
+	if !config.AlwaysUV {
+		// U2F has no user verification, so it is disabled when UV is always required
+		versions = append(versions, "U2F_V2")
+	}
+	credentialIDLength := server.credentialIDLength()
+	remainingResidentCredentials := server.remainingResidentCredentials()
+	// MAKE_CREDENTIAL always requires user verification once a PIN is set, so makeCredUvNotRqd is false
+	response := ctapGetInfoResponse{
+		Versions:   versions,
+		Extensions: ctapSupportedExtensions(),
+		AAGUID:     aaguid,
+		Options: ctapGetInfoOptions{
+			IsPlatform:                  false,
+			CanResidentKey:              true,
+			HasClientPIN:                server.client.PINHash() != nil,
+			CanUserPresence:             true,
+			CanUserVerification:         server.client.CanVerifyUser(),
+			HasPINUVAuthToken:           true,
+			HasUVToken:                  server.client.CanVerifyUser(),
+			CredentialManagement:        server.handlesCommand(ctap_COMMAND_CREDENTIAL_MANAGEMENT),
+			CredentialManagementPreview: server.handlesCommand(ctap_COMMAND_CREDENTIAL_MANAGEMENT_PREVIEW),
+			LargeBlobs:                  server.handlesCommand(ctap_COMMAND_LARGE_BLOBS),
+			AuthenticatorConfig:         server.handlesCommand(ctap_COMMAND_AUTHENTICATOR_CONFIG),
+			AlwaysUV:                    config.AlwaysUV,
+			SetMinPINLength:             server.handlesCommand(ctap_COMMAND_AUTHENTICATOR_CONFIG),
+			EnterpriseAttestation:       config.EnterpriseAttestation,
+			MakeCredUVNotRequired:       false,
+		},
+		MaxMessageSize:                   uint32(ctap_MAX_MESSAGE_SIZE),
+		PinProtocols:                     ctapSupportedPINProtocols,
+		MaxCredentialCountInList:         uint32((ctap_MAX_MESSAGE_SIZE - ctap_MAX_REQUEST_PARAMETERS_SIZE) / (credentialIDLength + ctap_CREDENTIAL_DESCRIPTOR_OVERHEAD)),
+		MaxCredentialIDLength:            uint32(credentialIDLength),
+		Transports:                       []string{"usb"},
+		Algorithms:                       ctapSupportedAlgorithmParams(),
+		MaxSerializedLargeBlobArray:      uint32(ctap_MAX_SERIALIZED_LARGE_BLOB_ARRAY),
+		ForcePINChange:                   config.ForcePINChange,
+		MinPINLength:                     config.MinPINLength,
+		FirmwareVersion:                  uint32(deviceVersionMajor)<<16 | uint32(deviceVersionMinor)<<8 | uint32(deviceVersionBuild),
+		MaxCredBlobLength:                uint32(ctap_MAX_CRED_BLOB_LENGTH),
+		MaxRPIDsForSetMinPINLength:       uint32(ctap_MAX_MIN_PIN_LENGTH_RPIDS),
+		RemainingDiscoverableCredentials: &remainingResidentCredentials,
+		AttestationFormats:               server.attestationFormatNames(),
+	}
+	ctapLogger.Printf("CTAP GET_INFO RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
@@ -3,6 +3,7 @@ package virtual_fido
 import (
 	"bytes"
 	"fmt"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -126,6 +127,17 @@ const (
 	ctapHIDSERVER_MAX_PACKET_SIZE int = 64
 )
 
+// Payload left in a packet after the initialization header (channel, command, length)
+// or the continuation header (channel, sequence number)
+const (
+	ctapHID_INIT_PACKET_PAYLOAD_SIZE int = ctapHIDSERVER_MAX_PACKET_SIZE - 7
+	ctapHID_CONT_PACKET_PAYLOAD_SIZE int = ctapHIDSERVER_MAX_PACKET_SIZE - 5
+)
+
+// Sequence numbers have 7 bits, which limits a message to one initialization packet
+// followed by 128 continuation packets
+const ctapHID_MAX_MESSAGE_SIZE int = ctapHID_INIT_PACKET_PAYLOAD_SIZE + 128*ctapHID_CONT_PACKET_PAYLOAD_SIZE
+
 type ctapHIDServer struct {
 	ctapServer          *ctapServer
 	u2fServer           *u2fServer
@@ -182,6 +194,10 @@ func (server *ctapHIDServer) removeWaitingRequest(id uint32) bool {
 	}
 }
 
+func (server *ctapHIDServer) powerUp() {
+	server.ctapServer.powerUp()
+}
+
 func (server *ctapHIDServer) sendResponse(response [][]byte) {
 	// Packets should be sequential and continuous per transaction
 	server.responsesLock.Lock()
@@ -277,6 +293,10 @@ func (channel *ctapHIDChannel) handleIntermediateMessage(server *ctapHIDServer,
 			return
 		}
 		payloadLength := readBE[uint16](buffer)
+		if int(payloadLength) > ctapHID_MAX_MESSAGE_SIZE {
+			server.sendResponse(ctapHidError(channel.channelId, ctapHID_ERR_INVALID_LENGTH))
+			return
+		}
 		header := ctapHIDMessageHeader{
 			ChannelID:     channel.channelId,
 			Command:       command,
@@ -298,6 +318,13 @@ func (channel *ctapHIDChannel) handleIntermediateMessage(server *ctapHIDServer,
 }
 
 func (channel *ctapHIDChannel) handleFinalizedMessage(server *ctapHIDServer, header ctapHIDMessageHeader, payload []byte) {
+	// Messages are handled on their own goroutine, so a panic here would crash the whole device
+	defer func() {
+		if err := recover(); err != nil {
+			ctapHIDLogger.Printf("ERROR: Message failed: %v\n%s\n\n", err, debug.Stack())
+			server.sendResponse(ctapHidError(header.ChannelID, ctapHID_ERR_OTHER))
+		}
+	}()
 	// TODO: Handle cancel message
 	ctapHIDLogger.Printf("CTAPHID FINALIZED MESSAGE: %s %#v\n\n", header, payload)
 	var response [][]byte = nil
@@ -314,13 +341,16 @@ func (channel *ctapHIDChannel) handleFinalizedMessage(server *ctapHIDServer, hea
 func (channel *ctapHIDChannel) handleBroadcastMessage(server *ctapHIDServer, header ctapHIDMessageHeader, payload []byte) [][]byte {
 	switch header.Command {
 	case ctapHID_COMMAND_INIT:
+		if len(payload) != 8 {
+			return ctapHidError(header.ChannelID, ctapHID_ERR_INVALID_LENGTH)
+		}
 		nonce := payload[:8]
 		response := ctapHIDInitReponse{
 			NewChannelID:       server.maxChannelID + 1,
 			ProtocolVersion:    2,
-			DeviceVersionMajor: 0,
-			DeviceVersionMinor: 0,
-			DeviceVersionBuild: 1,
+			DeviceVersionMajor: deviceVersionMajor,
+			DeviceVersionMinor: deviceVersionMinor,
+			DeviceVersionBuild: deviceVersionBuild,
 			CapabilitiesFlags:  0,
 		}
 		copy(response.Nonce[:], nonce)
@@ -331,7 +361,8 @@ func (channel *ctapHIDChannel) handleBroadcastMessage(server *ctapHIDServer, hea
 	case ctapHID_COMMAND_PING:
 		return createResponsePackets(ctapHID_BROADCAST_CHANNEL, ctapHID_COMMAND_PING, payload)
 	default:
-		panic(fmt.Sprintf("Invalid CTAPHID Broadcast command: %#v", header))
+		ctapHIDLogger.Printf("ERROR: Invalid CTAPHID Broadcast command: %#v\n\n", header)
+		return ctapHidError(header.ChannelID, ctapHID_ERR_INVALID_COMMAND)
 	}
 }
 
@@ -350,7 +381,8 @@ func (channel *ctapHIDChannel) handleDataMessage(server *ctapHIDServer, header c
 	case ctapHID_COMMAND_PING:
 		return createResponsePackets(header.ChannelID, ctapHID_COMMAND_PING, payload)
 	default:
-		panic(fmt.Sprintf("Invalid CTAPHID Channel command: %s", header))
+		ctapHIDLogger.Printf("ERROR: Invalid CTAPHID Channel command: %s\n\n", header)
+		return ctapHidError(header.ChannelID, ctapHID_ERR_INVALID_COMMAND)
 	}
 }
 
@@ -0,0 +1,76 @@
+package virtual_fido
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Length of each half of a credential's CredRandom
+const ctap_HMAC_SECRET_CRED_RANDOM_LENGTH int = 32
+
+type ctapHMACSecretInput struct {
+	KeyAgreement ctapCOSEPublicKey `cbor:"1,keyasint"`
+	SaltEnc      []byte            `cbor:"2,keyasint"`
+	SaltAuth     []byte            `cbor:"3,keyasint"`
+	PinProtocol  uint32            `cbor:"4,keyasint,omitempty"`
+}
+
+func (input ctapHMACSecretInput) String() string {
+	return fmt.Sprintf("ctapHMACSecretInput{KeyAgreement: %s, SaltEnc: %s, SaltAuth: %s, PinProtocol: %d}",
+		&input.KeyAgreement,
+		hex.EncodeToString(input.SaltEnc),
+		hex.EncodeToString(input.SaltAuth),
+		input.PinProtocol)
+}
+
+// The decrypted salts of an hmac-secret request, kept so that every assertion
+// of a GET_ASSERTION/GET_NEXT_ASSERTION sequence can compute its own output
+type ctapHMACSecretRequest struct {
+	protocol     ctapPINProtocol
+	sharedSecret []byte
+	salts        [][]byte
+}
+
+func (server *ctapServer) parseHMACSecretInput(input *ctapHMACSecretInput) (*ctapHMACSecretRequest, ctapStatusCode) {
+	protocolID := input.PinProtocol
+	if protocolID == 0 {
+		// Platforms that predate PIN protocol 2 omit the protocol
+		protocolID = 1
+	}
+	protocol, ok := ctapPINProtocols[protocolID]
+	if !ok || !input.KeyAgreement.isValidECDHKey() {
+		return nil, ctap1_ERR_INVALID_PARAMETER
+	}
+	sharedSecret := server.getPINSharedSecret(protocol, input.KeyAgreement)
+	if !ctapVerifyPINAuth(protocol, sharedSecret, input.SaltEnc, input.SaltAuth) {
+		ctapLogger.Printf("ERROR: Invalid hmac-secret salt authentication\n\n")
+		return nil, ctap2_ERR_PIN_AUTH_INVALID
+	}
+	salt, err := protocol.decrypt(sharedSecret, input.SaltEnc)
+	if err != nil || (len(salt) != 32 && len(salt) != 64) {
+		return nil, ctap1_ERR_INVALID_LENGTH
+	}
+	request := &ctapHMACSecretRequest{protocol: protocol, sharedSecret: sharedSecret}
+	for i := 0; i < len(salt); i += 32 {
+		request.salts = append(request.salts, salt[i:i+32])
+	}
+	return request, ctap1_ERR_SUCCESS
+}
+
+// Computes the encrypted hmac-secret output for a credential, or returns nil if the
+// credential was not created with hmac-secret
+func (request *ctapHMACSecretRequest) output(credentialSource *CredentialSource, userVerified bool) []byte {
+	if credentialSource.CredRandom == nil {
+		return nil
+	}
+	// Separate secrets are used with and without user verification
+	credRandom := credentialSource.CredRandom[:ctap_HMAC_SECRET_CRED_RANDOM_LENGTH]
+	if userVerified {
+		credRandom = credentialSource.CredRandom[ctap_HMAC_SECRET_CRED_RANDOM_LENGTH:]
+	}
+	outputs := make([][]byte, 0, len(request.salts))
+	for _, salt := range request.salts {
+		outputs = append(outputs, hmacSHA256(credRandom, salt))
+	}
+	return request.protocol.encrypt(request.sharedSecret, flatten(outputs))
+}
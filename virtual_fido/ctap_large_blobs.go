@@ -0,0 +1,147 @@
+package virtual_fido
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	ctap_MAX_SERIALIZED_LARGE_BLOB_ARRAY int = 4096
+	ctap_MAX_LARGE_BLOB_FRAGMENT_LENGTH  int = ctap_MAX_MESSAGE_SIZE - 64
+	// The serialized array ends with a truncated SHA-256 hash of its contents
+	ctap_LARGE_BLOB_HASH_LENGTH int = 16
+)
+
+// An empty CBOR array followed by its truncated hash
+func ctapEmptyLargeBlobArray() []byte {
+	emptyArray := []byte{0x80}
+	return append(emptyArray, hashSHA256(emptyArray)[:ctap_LARGE_BLOB_HASH_LENGTH]...)
+}
+
+type ctapLargeBlobsArgs struct {
+	Get         *uint32 `cbor:"1,keyasint,omitempty"`
+	Set         []byte  `cbor:"2,keyasint,omitempty"`
+	Offset      *uint32 `cbor:"3,keyasint,omitempty"`
+	Length      *uint32 `cbor:"4,keyasint,omitempty"`
+	PinAuth     []byte  `cbor:"5,keyasint,omitempty"`
+	PinProtocol uint32  `cbor:"6,keyasint,omitempty"`
+}
+
+func (args ctapLargeBlobsArgs) String() string {
+	return fmt.Sprintf("ctapLargeBlobsArgs{Get: %v, Set: %d bytes, Offset: %v, Length: %v, PinAuth: %s, PinProtocol: %d}",
+		args.Get,
+		len(args.Set),
+		args.Offset,
+		args.Length,
+		hex.EncodeToString(args.PinAuth),
+		args.PinProtocol)
+}
+
+type ctapLargeBlobsResponse struct {
+	Config []byte `cbor:"1,keyasint"`
+}
+
+// A serialized large blob array being written over several SET requests
+type ctapLargeBlobsWrite struct {
+	expectedLength     int
+	expectedNextOffset int
+	buffer             []byte
+}
+
+func (server *ctapServer) handleLargeBlobs(data []byte) []byte {
+	var args ctapLargeBlobsArgs
+	status := ctapDecodeRequest(data, &args)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
+	ctapLogger.Printf("LARGE BLOBS: %v\n\n", args)
+	if args.Offset == nil {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	if (args.Get == nil) == (args.Set == nil) {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	if args.Get != nil {
+		return server.handleLargeBlobsGet(args)
+	}
+	return server.handleLargeBlobsSet(args)
+}
+
+func (server *ctapServer) handleLargeBlobsGet(args ctapLargeBlobsArgs) []byte {
+	if args.Length != nil {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	if int(*args.Get) > ctap_MAX_LARGE_BLOB_FRAGMENT_LENGTH {
+		return []byte{byte(ctap1_ERR_INVALID_LENGTH)}
+	}
+	largeBlobs := server.client.LargeBlobs()
+	offset := int(*args.Offset)
+	if offset > len(largeBlobs) {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	end := offset + int(*args.Get)
+	if end > len(largeBlobs) {
+		end = len(largeBlobs)
+	}
+	response := ctapLargeBlobsResponse{Config: largeBlobs[offset:end]}
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
+
+func (server *ctapServer) handleLargeBlobsSet(args ctapLargeBlobsArgs) []byte {
+	if len(args.Set) > ctap_MAX_LARGE_BLOB_FRAGMENT_LENGTH {
+		return []byte{byte(ctap1_ERR_INVALID_LENGTH)}
+	}
+	offset := int(*args.Offset)
+	if offset == 0 {
+		if args.Length == nil {
+			return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+		}
+		if int(*args.Length) > ctap_MAX_SERIALIZED_LARGE_BLOB_ARRAY {
+			return []byte{byte(ctap2_ERR_LARGE_BLOB_STORAGE_FULL)}
+		}
+		if int(*args.Length) < ctap_LARGE_BLOB_HASH_LENGTH+1 {
+			return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+		}
+		server.largeBlobsWrite = &ctapLargeBlobsWrite{
+			expectedLength:     int(*args.Length),
+			expectedNextOffset: 0,
+			buffer:             make([]byte, 0, *args.Length),
+		}
+	} else if args.Length != nil {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	write := server.largeBlobsWrite
+	if write == nil || offset != write.expectedNextOffset {
+		return []byte{byte(ctap1_ERR_INVALID_SEQ)}
+	}
+	if server.client.PINHash() != nil {
+		if args.PinAuth == nil {
+			return []byte{byte(ctap2_ERR_PIN_REQUIRED)}
+		}
+		setHash := sha256.Sum256(args.Set)
+		message := flatten([][]byte{bytes.Repeat([]byte{0xff}, 32), {byte(ctap_COMMAND_LARGE_BLOBS), 0x00}, toLE(uint32(offset)), setHash[:]})
+		status := server.verifyPINAuth(args.PinProtocol, args.PinAuth, message, ctap_PIN_TOKEN_PERMISSION_LARGE_BLOB_WRITE, "")
+		if status != ctap1_ERR_SUCCESS {
+			return []byte{byte(status)}
+		}
+	}
+	if offset+len(args.Set) > write.expectedLength {
+		return []byte{byte(ctap1_ERR_INVALID_PARAMETER)}
+	}
+	write.buffer = append(write.buffer, args.Set...)
+	write.expectedNextOffset = len(write.buffer)
+	if len(write.buffer) < write.expectedLength {
+		return []byte{byte(ctap1_ERR_SUCCESS)}
+	}
+	server.largeBlobsWrite = nil
+	contents := write.buffer[:len(write.buffer)-ctap_LARGE_BLOB_HASH_LENGTH]
+	expectedHash := write.buffer[len(write.buffer)-ctap_LARGE_BLOB_HASH_LENGTH:]
+	if !bytes.Equal(hashSHA256(contents)[:ctap_LARGE_BLOB_HASH_LENGTH], expectedHash) {
+		ctapLogger.Printf("ERROR: Large blob array hash mismatch\n\n")
+		return []byte{byte(ctap2_ERR_INTEGRITY_FAILURE)}
+	}
+	server.client.SetLargeBlobs(write.buffer)
+	return []byte{byte(ctap1_ERR_SUCCESS)}
+}
@@ -0,0 +1,89 @@
+package virtual_fido
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// A PIN/UV auth protocol, which defines how the shared secret between the platform
+// and the authenticator is derived and used to encrypt and authenticate PIN messages
+type ctapPINProtocol interface {
+	deriveSharedSecret(z []byte) []byte
+	encrypt(key []byte, data []byte) []byte
+	decrypt(key []byte, data []byte) ([]byte, error)
+	authenticate(key []byte, message []byte) []byte
+}
+
+// Protocol 1: SHA-256 shared secret, AES-CBC with a zero IV and truncated HMACs
+type ctapPINProtocolOne struct{}
+
+func (protocol ctapPINProtocolOne) deriveSharedSecret(z []byte) []byte {
+	return hashSHA256(z)
+}
+
+func (protocol ctapPINProtocolOne) encrypt(key []byte, data []byte) []byte {
+	return encryptAESCBC(key, make([]byte, aes.BlockSize), data)
+}
+
+func (protocol ctapPINProtocolOne) decrypt(key []byte, data []byte) ([]byte, error) {
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid ciphertext length: %d", len(data))
+	}
+	return decryptAESCBC(key, make([]byte, aes.BlockSize), data), nil
+}
+
+func (protocol ctapPINProtocolOne) authenticate(key []byte, message []byte) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(message)
+	return hash.Sum(nil)[:16]
+}
+
+// Protocol 2: HKDF-derived HMAC and AES keys, random IVs and full HMACs
+type ctapPINProtocolTwo struct{}
+
+func (protocol ctapPINProtocolTwo) deriveSharedSecret(z []byte) []byte {
+	salt := make([]byte, 32)
+	hmacKey := hkdfSHA256(z, salt, []byte("CTAP2 HMAC key"), 32)
+	aesKey := hkdfSHA256(z, salt, []byte("CTAP2 AES key"), 32)
+	return append(hmacKey, aesKey...)
+}
+
+func (protocol ctapPINProtocolTwo) aesKey(key []byte) []byte {
+	if len(key) == 64 {
+		return key[32:]
+	}
+	// PIN tokens are used directly as both HMAC and AES keys
+	return key
+}
+
+func (protocol ctapPINProtocolTwo) encrypt(key []byte, data []byte) []byte {
+	iv := randomBytes(aes.BlockSize)
+	return append(iv, encryptAESCBC(protocol.aesKey(key), iv, data)...)
+}
+
+func (protocol ctapPINProtocolTwo) decrypt(key []byte, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid ciphertext length: %d", len(data))
+	}
+	return decryptAESCBC(protocol.aesKey(key), data[:aes.BlockSize], data[aes.BlockSize:]), nil
+}
+
+func (protocol ctapPINProtocolTwo) authenticate(key []byte, message []byte) []byte {
+	hash := hmac.New(sha256.New, key[:32])
+	hash.Write(message)
+	return hash.Sum(nil)
+}
+
+var ctapPINProtocols = map[uint32]ctapPINProtocol{
+	1: ctapPINProtocolOne{},
+	2: ctapPINProtocolTwo{},
+}
+
+// Protocols in order of preference, as advertised in GET_INFO
+var ctapSupportedPINProtocols = []uint32{2, 1}
+
+func ctapVerifyPINAuth(protocol ctapPINProtocol, key []byte, message []byte, pinAuth []byte) bool {
+	return hmac.Equal(protocol.authenticate(key, message), pinAuth)
+}
@@ -0,0 +1,349 @@
+package virtual_fido
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/hkdf"
+)
+
+type testClientSupport struct {
+	data []byte
+}
+
+func (support *testClientSupport) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	return true
+}
+
+func (support *testClientSupport) SaveData(data []byte) {
+	support.data = data
+}
+
+func (support *testClientSupport) RetrieveData() []byte {
+	return support.data
+}
+
+func (support *testClientSupport) Passphrase() string {
+	return "passphrase"
+}
+
+func newTestCertificateAuthority(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(0),
+		Subject:               pkix.Name{Organization: []string{"Virtual FIDO Test"}},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, privateKey
+}
+
+func newTestClient(t *testing.T, support *testClientSupport) *DefaultFIDOClient {
+	certificate, privateKey := newTestCertificateAuthority(t)
+	return NewClient(certificate, privateKey, sha256.Sum256([]byte("test")), support, support)
+}
+
+// Sends a CTAP request and decodes the response into response, returning the status code
+func testRequest(t *testing.T, server *ctapServer, command ctapCommand, args interface{}, response interface{}) ctapStatusCode {
+	data := []byte{byte(command)}
+	if args != nil {
+		data = append(data, marshalCBOR(args)...)
+	}
+	result := server.handleMessage(data)
+	status := ctapStatusCode(result[0])
+	if status == ctap1_ERR_SUCCESS && response != nil {
+		if err := cbor.Unmarshal(result[1:], response); err != nil {
+			t.Fatalf("Could not decode response: %v", err)
+		}
+	}
+	return status
+}
+
+// The platform side of a PIN protocol session with the server
+type testPlatform struct {
+	protocolID   uint32
+	protocol     ctapPINProtocol
+	key          *ECDHKey
+	sharedSecret []byte
+}
+
+func newTestPlatform(t *testing.T, server *ctapServer, protocolID uint32) *testPlatform {
+	var response ctapClientPINResponse
+	args := ctapClientPINArgs{PinProtocol: protocolID, SubCommand: ctap_CLIENT_PIN_SUBCOMMAND_GET_KEY_AGREEMENT}
+	if status := testRequest(t, server, ctap_COMMAND_CLIENT_PIN, args, &response); status != ctap1_ERR_SUCCESS {
+		t.Fatalf("Could not get key agreement: %#x", status)
+	}
+	platform := &testPlatform{protocolID: protocolID, protocol: ctapPINProtocols[protocolID], key: generateECDHKey()}
+	z := platform.key.ECDH(bytesToBigInt(response.KeyAgreement.X), bytesToBigInt(response.KeyAgreement.Y))
+	platform.sharedSecret = platform.protocol.deriveSharedSecret(z)
+	return platform
+}
+
+func (platform *testPlatform) publicKey() *ctapCOSEPublicKey {
+	return &ctapCOSEPublicKey{
+		KeyType:   int8(cose_KEY_TYPE_EC2),
+		Algorithm: int8(cose_ALGORITHM_ID_ECDH_HKDF_256),
+		Curve:     int8(cose_CURVE_ID_P256),
+		X:         platform.key.x.FillBytes(make([]byte, 32)),
+		Y:         platform.key.y.FillBytes(make([]byte, 32)),
+	}
+}
+
+func (platform *testPlatform) setPIN(t *testing.T, server *ctapServer, pin string) ctapStatusCode {
+	newPINEncoding := platform.protocol.encrypt(platform.sharedSecret, pad([]byte(pin), 64))
+	return testRequest(t, server, ctap_COMMAND_CLIENT_PIN, ctapClientPINArgs{
+		PinProtocol:    platform.protocolID,
+		SubCommand:     ctap_CLIENT_PIN_SUBCOMMAND_SET_PIN,
+		KeyAgreement:   platform.publicKey(),
+		NewPINEncoding: newPINEncoding,
+		PINAuth:        platform.protocol.authenticate(platform.sharedSecret, newPINEncoding),
+	}, nil)
+}
+
+func (platform *testPlatform) getPINToken(t *testing.T, server *ctapServer, pin string) ctapStatusCode {
+	return testRequest(t, server, ctap_COMMAND_CLIENT_PIN, ctapClientPINArgs{
+		PinProtocol:     platform.protocolID,
+		SubCommand:      ctap_CLIENT_PIN_SUBCOMMAND_GET_PIN_TOKEN,
+		KeyAgreement:    platform.publicKey(),
+		PINHashEncoding: platform.protocol.encrypt(platform.sharedSecret, hashSHA256([]byte(pin))[:16]),
+	}, nil)
+}
+
+func testMakeCredentialArgs(rpID string, algorithm coseAlgorithmID) ctapMakeCredentialArgs {
+	return ctapMakeCredentialArgs{
+		ClientDataHash:   hashSHA256([]byte("client data")),
+		Rp:               PublicKeyCredentialRpEntity{Id: rpID, Name: rpID},
+		User:             PublicKeyCrendentialUserEntity{Id: []byte{1}, Name: "user"},
+		PubKeyCredParams: []PublicKeyCredentialParams{{Type: "public-key", Algorithm: algorithm}},
+	}
+}
+
+// Reads the credential ID from the attested credential data of a MAKE_CREDENTIAL response
+func testCredentialID(authData []byte) []byte {
+	const credentialIDOffset = 32 + 1 + 4 + 16 + 2
+	length := int(authData[credentialIDOffset-2])<<8 | int(authData[credentialIDOffset-1])
+	return authData[credentialIDOffset : credentialIDOffset+length]
+}
+
+// A credential ID shaped like a sealed box, but with a nonce that AES-GCM can't use
+func testMalformedCredentialID() []byte {
+	return marshalCBOR(encryptedBox{Data: make([]byte, 48), IV: []byte{1, 2, 3}})
+}
+
+func TestPINProtocolTwoSharedSecret(t *testing.T) {
+	protocol := ctapPINProtocolTwo{}
+	z := randomBytes(32)
+	sharedSecret := protocol.deriveSharedSecret(z)
+	if len(sharedSecret) != 64 {
+		t.Fatalf("Expected a 64 byte shared secret, got %d bytes", len(sharedSecret))
+	}
+	for i, info := range []string{"CTAP2 HMAC key", "CTAP2 AES key"} {
+		expected := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, z, make([]byte, 32), []byte(info)), expected); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sharedSecret[i*32:(i+1)*32], expected) {
+			t.Errorf("Shared secret half %d does not match HKDF with info %q", i, info)
+		}
+	}
+}
+
+func TestPINProtocolTwoEncryption(t *testing.T) {
+	protocol := ctapPINProtocolTwo{}
+	sharedSecret := protocol.deriveSharedSecret(randomBytes(32))
+	plaintext := pad([]byte("1234"), 64)
+	first := protocol.encrypt(sharedSecret, plaintext)
+	second := protocol.encrypt(sharedSecret, plaintext)
+	if len(first) != 16+len(plaintext) {
+		t.Fatalf("Expected the IV followed by the ciphertext, got %d bytes", len(first))
+	}
+	if bytes.Equal(first[:16], second[:16]) {
+		t.Error("Expected a random IV for each encryption")
+	}
+	for _, ciphertext := range [][]byte{first, second} {
+		decrypted, err := protocol.decrypt(sharedSecret, ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Error("Decrypted data does not match the plaintext")
+		}
+	}
+	if _, err := protocol.decrypt(sharedSecret, first[:20]); err == nil {
+		t.Error("Expected an error for a truncated ciphertext")
+	}
+}
+
+func TestPINProtocolTwoAuthenticate(t *testing.T) {
+	protocol := ctapPINProtocolTwo{}
+	sharedSecret := protocol.deriveSharedSecret(randomBytes(32))
+	message := []byte("message")
+	pinAuth := protocol.authenticate(sharedSecret, message)
+	if len(pinAuth) != 32 {
+		t.Fatalf("Expected a 32 byte HMAC, got %d bytes", len(pinAuth))
+	}
+	if !ctapVerifyPINAuth(protocol, sharedSecret, message, pinAuth) {
+		t.Error("Expected the HMAC to verify")
+	}
+	if ctapVerifyPINAuth(protocol, sharedSecret, message, pinAuth[:16]) {
+		t.Error("Expected a truncated HMAC to be rejected")
+	}
+}
+
+func TestPINLockout(t *testing.T) {
+	support := &testClientSupport{}
+	client := newTestClient(t, support)
+	server := newCTAPServer(client)
+	if status := newTestPlatform(t, server, 2).setPIN(t, server, "1234"); status != ctap1_ERR_SUCCESS {
+		t.Fatalf("Could not set PIN: %#x", status)
+	}
+
+	expected := []ctapStatusCode{ctap2_ERR_PIN_INVALID, ctap2_ERR_PIN_INVALID, ctap2_ERR_PIN_AUTH_BLOCKED}
+	for i, expectedStatus := range expected {
+		keyAgreement := client.PINKeyAgreement()
+		if status := newTestPlatform(t, server, 2).getPINToken(t, server, "0000"); status != expectedStatus {
+			t.Fatalf("Wrong PIN %d: expected %#x, got %#x", i+1, expectedStatus, status)
+		}
+		if client.PINKeyAgreement() == keyAgreement {
+			t.Errorf("Wrong PIN %d: expected the key agreement key to change", i+1)
+		}
+	}
+	// The correct PIN is refused too until the device is power cycled
+	if status := newTestPlatform(t, server, 2).getPINToken(t, server, "1234"); status != ctap2_ERR_PIN_AUTH_BLOCKED {
+		t.Fatalf("Expected PIN entry to be blocked, got %#x", status)
+	}
+	if retries := client.PINRetries(); retries != ctap_MAX_PIN_RETRIES-3 {
+		t.Fatalf("Expected %d retries, got %d", ctap_MAX_PIN_RETRIES-3, retries)
+	}
+
+	restarted := newTestClient(t, support)
+	if retries := restarted.PINRetries(); retries != ctap_MAX_PIN_RETRIES-3 {
+		t.Fatalf("Expected %d retries after restarting, got %d", ctap_MAX_PIN_RETRIES-3, retries)
+	}
+
+	server.powerUp()
+	if status := newTestPlatform(t, server, 2).getPINToken(t, server, "1234"); status != ctap1_ERR_SUCCESS {
+		t.Fatalf("Expected the correct PIN after a power cycle, got %#x", status)
+	}
+	if retries := client.PINRetries(); retries != ctap_MAX_PIN_RETRIES {
+		t.Fatalf("Expected the retries to be restored, got %d", retries)
+	}
+}
+
+func TestWrappedCredential(t *testing.T) {
+	server := newCTAPServer(newTestClient(t, &testClientSupport{}))
+	for _, algorithm := range ctapSupportedAlgorithms {
+		options := CredentialOptions{Algorithm: algorithm, CredProtect: CredentialProtectionUVOptionalWithCredentialIDList, CredBlob: []byte("blob")}
+		source := newCredentialSource(PublicKeyCredentialRpEntity{Id: "example.com"}, PublicKeyCrendentialUserEntity{}, options)
+		credentialID := server.wrapCredential(source)
+		if len(credentialID) > server.credentialIDLength() {
+			t.Errorf("Algorithm %d: credential ID is longer than the advertised maximum", algorithm)
+		}
+
+		unwrapped := server.unwrapCredential("example.com", credentialID)
+		if unwrapped == nil {
+			t.Fatalf("Algorithm %d: could not unwrap credential", algorithm)
+		}
+		publicKey := source.PrivateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !publicKey.Equal(unwrapped.PrivateKey.Public()) {
+			t.Errorf("Algorithm %d: unwrapped key does not match", algorithm)
+		}
+		if rsaKey, ok := source.PrivateKey.Public().(*rsa.PublicKey); ok {
+			// RSA keys are rebuilt from their primes, so check that they still sign correctly
+			message := []byte("message")
+			hash := sha256.Sum256(message)
+			if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], sign(unwrapped.PrivateKey, message)); err != nil {
+				t.Errorf("Rebuilt RSA key does not sign correctly: %v", err)
+			}
+		}
+		if unwrapped.CredProtect != source.CredProtect || !bytes.Equal(unwrapped.CredBlob, source.CredBlob) {
+			t.Errorf("Algorithm %d: credential options were not preserved", algorithm)
+		}
+
+		if server.unwrapCredential("other.com", credentialID) != nil {
+			t.Errorf("Algorithm %d: credential ID was accepted for another relying party", algorithm)
+		}
+	}
+}
+
+func TestMalformedCredentialIDNonce(t *testing.T) {
+	server := newCTAPServer(newTestClient(t, &testClientSupport{}))
+	descriptors := []PublicKeyCredentialDescriptor{{Type: "public-key", Id: testMalformedCredentialID()}}
+
+	getAssertion := ctapGetAssertionArgs{RpID: "example.com", ClientDataHash: hashSHA256([]byte("client data")), AllowList: descriptors}
+	if status := testRequest(t, server, ctap_COMMAND_GET_ASSERTION, getAssertion, nil); status != ctap2_ERR_NO_CREDENTIALS {
+		t.Errorf("GET_ASSERTION: expected %#x, got %#x", ctap2_ERR_NO_CREDENTIALS, status)
+	}
+
+	makeCredential := testMakeCredentialArgs("example.com", cose_ALGORITHM_ID_ES256)
+	makeCredential.ExcludeList = descriptors
+	if status := testRequest(t, server, ctap_COMMAND_MAKE_CREDENTIAL, makeCredential, nil); status != ctap1_ERR_SUCCESS {
+		t.Errorf("MAKE_CREDENTIAL: expected success, got %#x", status)
+	}
+}
+
+func testU2FAuthenticate(server *u2fServer, keyHandle []byte, application []byte) u2fStatusWord {
+	request := flatten([][]byte{hashSHA256([]byte("challenge")), application, {byte(len(keyHandle))}, keyHandle})
+	header := []byte{0, byte(u2f_COMMAND_AUTHENTICATE), byte(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN), 0}
+	response := server.handleU2FMessage(flatten([][]byte{header, {0}, toBE(uint16(len(request))), request}))
+	return u2fStatusWord(response[len(response)-2])<<8 | u2fStatusWord(response[len(response)-1])
+}
+
+func TestU2FAuthenticateForeignKeyHandles(t *testing.T) {
+	client := newTestClient(t, &testClientSupport{})
+	ctapServer := newCTAPServer(client)
+	u2fServer := newU2FServer(client)
+	application := hashSHA256([]byte("example.com"))
+
+	var response ctapMakeCredentialReponse
+	args := testMakeCredentialArgs("example.com", cose_ALGORITHM_ID_EDDSA)
+	if status := testRequest(t, ctapServer, ctap_COMMAND_MAKE_CREDENTIAL, args, &response); status != ctap1_ERR_SUCCESS {
+		t.Fatalf("Could not make credential: %#x", status)
+	}
+	keyHandles := map[string][]byte{
+		"Ed25519 credential ID":   testCredentialID(response.AuthData),
+		"malformed nonce":         testMalformedCredentialID(),
+		"sealed by another key":   marshalCBOR(seal(randomBytes(32), []byte("key handle"))),
+		"not a sealed key handle": []byte("key handle"),
+	}
+	for name, keyHandle := range keyHandles {
+		if status := testU2FAuthenticate(u2fServer, keyHandle, application); status != u2f_SW_WRONG_DATA {
+			t.Errorf("%s: expected %#x, got %#x", name, u2f_SW_WRONG_DATA, status)
+		}
+	}
+}
+
+func TestU2FAuthenticateWithCTAPCredential(t *testing.T) {
+	client := newTestClient(t, &testClientSupport{})
+	var response ctapMakeCredentialReponse
+	args := testMakeCredentialArgs("example.com", cose_ALGORITHM_ID_ES256)
+	if status := testRequest(t, newCTAPServer(client), ctap_COMMAND_MAKE_CREDENTIAL, args, &response); status != ctap1_ERR_SUCCESS {
+		t.Fatalf("Could not make credential: %#x", status)
+	}
+	status := testU2FAuthenticate(newU2FServer(client), testCredentialID(response.AuthData), hashSHA256([]byte("example.com")))
+	if status != u2f_SW_NO_ERROR {
+		t.Fatalf("Expected a P-256 credential to work with U2F, got %#x", status)
+	}
+}
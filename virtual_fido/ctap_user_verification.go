@@ -0,0 +1,67 @@
+package virtual_fido
+
+// Consecutive failed built-in user verifications allowed before it is blocked
+const ctap_MAX_UV_RETRIES int32 = 5
+
+// With alwaysUv set, requests without a PIN token fall back to built-in user verification
+func (server *ctapServer) builtInUVRequired() bool {
+	return server.client.AuthenticatorConfig().AlwaysUV && server.client.CanVerifyUser()
+}
+
+// Verifies the user with the client's built-in method. Failures count against the UV retries,
+// which are separate from the PIN retries; once they run out, only the PIN can unblock UV.
+func (server *ctapServer) performBuiltInUV(relyingParty string) ctapStatusCode {
+	if !server.client.CanVerifyUser() {
+		ctapLogger.Printf("ERROR: No built-in user verification\n\n")
+		return ctap2_ERR_INVALID_OPTION
+	}
+	retries := server.client.UVRetries()
+	if retries <= 0 {
+		ctapLogger.Printf("ERROR: Built-in user verification is blocked\n\n")
+		return ctap2_ERR_UV_BLOCKED
+	}
+	if server.client.VerifyUser(relyingParty) {
+		server.resetUVRetries()
+		return ctap1_ERR_SUCCESS
+	}
+	retries--
+	server.client.SetUVRetries(retries)
+	ctapLogger.Printf("ERROR: User verification failed, %d retries left\n\n", retries)
+	if retries <= 0 {
+		return ctap2_ERR_UV_BLOCKED
+	}
+	return ctap2_ERR_UV_INVALID
+}
+
+func (server *ctapServer) resetUVRetries() {
+	if server.client.UVRetries() != ctap_MAX_UV_RETRIES {
+		server.client.SetUVRetries(ctap_MAX_UV_RETRIES)
+	}
+}
+
+func (server *ctapServer) handleGetPINUVTokenUsingUV(protocol ctapPINProtocol, args ctapClientPINArgs) []byte {
+	if args.KeyAgreement == nil || args.KeyAgreement.X == nil {
+		return []byte{byte(ctap2_ERR_MISSING_PARAM)}
+	}
+	if !server.client.CanVerifyUser() {
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	status := server.performBuiltInUV(args.RpID)
+	if status != ctap1_ERR_SUCCESS {
+		return []byte{byte(status)}
+	}
+	sharedSecret := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	return server.issuePINToken(protocol, sharedSecret, args.Permissions, args.RpID)
+}
+
+func (server *ctapServer) handleGetUVRetries() []byte {
+	if !server.client.CanVerifyUser() {
+		return []byte{byte(ctap2_ERR_NOT_ALLOWED)}
+	}
+	retries := uint8(server.client.UVRetries())
+	response := ctapClientPINResponse{
+		UVRetries: &retries,
+	}
+	ctapLogger.Printf("CTAP_CLIENT_PIN_GET_UV_RETRIES: %v\n\n", response)
+	return append([]byte{byte(ctap1_ERR_SUCCESS)}, marshalCBOR(response)...)
+}
@@ -0,0 +1,85 @@
+package virtual_fido
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// A non-discoverable credential, sealed with the device key to form its own credential ID.
+// The first two fields match the layout of U2F key handles, so credentials registered
+// through U2F can also be used for CTAP2 assertions, and the other way around for P-256 keys.
+// RSA keys only keep their primes, since the full key is too large for a credential ID.
+type ctapWrappedCredential struct {
+	PrivateKey  []byte   `cbor:"1,keyasint,omitempty"`
+	RpIDHash    []byte   `cbor:"2,keyasint"`
+	CredRandom  []byte   `cbor:"3,keyasint,omitempty"`
+	CredProtect uint8    `cbor:"4,keyasint,omitempty"`
+	CredBlob    []byte   `cbor:"5,keyasint,omitempty"`
+	RSAPrimes   [][]byte `cbor:"6,keyasint,omitempty"`
+}
+
+func (server *ctapServer) wrapCredential(source *CredentialSource) []byte {
+	wrapped := ctapWrappedCredential{
+		RpIDHash:    hashSHA256([]byte(source.RelyingParty.Id)),
+		CredRandom:  source.CredRandom,
+		CredProtect: uint8(source.CredProtect),
+		CredBlob:    source.CredBlob,
+	}
+	if rsaKey, ok := source.PrivateKey.(*rsa.PrivateKey); ok {
+		wrapped.RSAPrimes = marshalRSAPrimes(rsaKey)
+	} else {
+		wrapped.PrivateKey = marshalPrivateKey(source.PrivateKey)
+	}
+	box := seal(server.client.SealingEncryptionKey(), marshalCBOR(wrapped))
+	return marshalCBOR(box)
+}
+
+// Recovers the credential wrapped in a credential ID, or returns nil if the ID was not
+// created by this device for the relying party
+func (server *ctapServer) unwrapCredential(rpID string, credentialID []byte) *CredentialSource {
+	var box encryptedBox
+	if cbor.Unmarshal(credentialID, &box) != nil {
+		return nil
+	}
+	data, err := decrypt(server.client.SealingEncryptionKey(), box.Data, box.IV)
+	if err != nil {
+		return nil
+	}
+	var wrapped ctapWrappedCredential
+	if cbor.Unmarshal(data, &wrapped) != nil || !bytes.Equal(wrapped.RpIDHash, hashSHA256([]byte(rpID))) {
+		return nil
+	}
+	var privateKey crypto.Signer
+	if wrapped.RSAPrimes != nil {
+		privateKey, err = parseRSAPrimes(wrapped.RSAPrimes)
+	} else {
+		privateKey, err = parsePrivateKey(wrapped.PrivateKey)
+	}
+	if err != nil {
+		ctapLogger.Printf("ERROR: Invalid private key in credential ID: %s\n\n", err)
+		return nil
+	}
+	return &CredentialSource{
+		Type:         "public-key",
+		ID:           credentialID,
+		PrivateKey:   privateKey,
+		RelyingParty: PublicKeyCredentialRpEntity{Id: rpID, Name: rpID},
+		CredRandom:   wrapped.CredRandom,
+		CredProtect:  CredentialProtection(wrapped.CredProtect),
+		CredBlob:     wrapped.CredBlob,
+	}
+}
+
+// Returns the first credential of the allow list that is wrapped in its ID and usable
+func (server *ctapServer) unwrapAllowList(rpID string, allowList []PublicKeyCredentialDescriptor, userVerified bool) []*CredentialSource {
+	for _, descriptor := range allowList {
+		source := server.unwrapCredential(rpID, descriptor.Id)
+		if source != nil && source.usable(userVerified, true) {
+			return []*CredentialSource{source}
+		}
+	}
+	return nil
+}
@@ -10,6 +10,8 @@ func (device *dummyUSBDevice) removeWaitingRequest(id uint32) bool {
 	return false
 }
 
+func (device *dummyUSBDevice) powerUp() {}
+
 func (device *dummyUSBDevice) usbipSummary() usbipDeviceSummary {
 	return usbipDeviceSummary{
 		Header:          device.usbipSummaryHeader(),
@@ -6,6 +6,9 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"math/big"
 	"time"
@@ -16,21 +19,76 @@ type ClientAction uint8
 type ClientActionRequestParams struct {
 	RelyingParty string
 	UserName     string
+	// Set when creating an account overwrites the existing account UserName on the relying party
+	ReplacesAccount bool
 }
 
 const (
-	ClientActionU2FRegister        ClientAction = 0
-	ClientActionU2FAuthenticate    ClientAction = 1
-	ClientActionFIDOMakeCredential ClientAction = 2
-	ClientActionFIDOGetAssertion   ClientAction = 3
+	ClientActionU2FRegister            ClientAction = 0
+	ClientActionU2FAuthenticate        ClientAction = 1
+	ClientActionFIDOMakeCredential     ClientAction = 2
+	ClientActionFIDOGetAssertion       ClientAction = 3
+	ClientActionFIDOReset              ClientAction = 4
+	ClientActionFIDOSelectDevice       ClientAction = 5
+	ClientActionFIDOCredentialExcluded ClientAction = 6
 )
 
 var clientLogger *log.Logger = newLogger("[CLIENT] ", false)
 
+// How packed attestation statements for new FIDO2 credentials are signed. Attestation
+// is left out entirely by allowing only AttestationFormatNone.
+type AttestationType uint8
+
+const (
+	// Signed by the credential's own key, so credentials can't be linked to the device
+	AttestationTypeSelf AttestationType = 0
+	// Signed by a device attestation key, certified by the attestation CA
+	AttestationTypeBasic AttestationType = 1
+)
+
+// Attestation statement formats, identified by their WebAuthn names
+type AttestationFormat string
+
+const (
+	AttestationFormatPacked  AttestationFormat = "packed"
+	AttestationFormatFIDOU2F AttestationFormat = "fido-u2f"
+	AttestationFormatNone    AttestationFormat = "none"
+)
+
+// Certificate extension carrying the authenticator's AAGUID (id-fido-gen-ce-aaguid)
+var attestationAAGUIDExtensionID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Authenticator settings that the platform can change through authenticatorConfig
+type AuthenticatorConfig struct {
+	AlwaysUV              bool     `json:"always_uv"`
+	MinPINLength          uint32   `json:"min_pin_length"`
+	MinPINLengthRPIDs     []string `json:"min_pin_length_rp_ids,omitempty"`
+	ForcePINChange        bool     `json:"force_pin_change"`
+	EnterpriseAttestation bool     `json:"enterprise_attestation"`
+	PINCodePointLength    uint32   `json:"pin_code_point_length,omitempty"`
+}
+
+func defaultAuthenticatorConfig() AuthenticatorConfig {
+	return AuthenticatorConfig{MinPINLength: ctap_DEFAULT_MIN_PIN_LENGTH}
+}
+
 type ClientRequestApprover interface {
 	ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool
 }
 
+// Optionally implemented by a ClientRequestApprover to let the user pick which account
+// logs in when several match a relying party. Returns the index of the chosen account,
+// or -1 if the user declined the login.
+type ClientAccountChooser interface {
+	ChooseAccount(accounts []ClientActionRequestParams) int
+}
+
+// Performs on-device user verification, e.g. by asking the user to re-enter the vault
+// passphrase or by running an external command. Returns whether the user was verified.
+type UserVerifier interface {
+	VerifyUser(params ClientActionRequestParams) bool
+}
+
 type ClientDataSaver interface {
 	SaveData(data []byte)
 	RetrieveData() []byte
@@ -38,23 +96,51 @@ type ClientDataSaver interface {
 }
 
 type FIDOClient interface {
-	NewCredentialSource(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity) *CredentialSource
-	GetAssertionSource(relyingPartyID string, allowList []PublicKeyCredentialDescriptor) *CredentialSource
+	NewCredentialSource(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity, options CredentialOptions) *CredentialSource
+	GetAssertionSources(relyingPartyID string, allowList []PublicKeyCredentialDescriptor, userVerified bool) []*CredentialSource
+	IncrementSignatureCounter(credentialSource *CredentialSource)
+	Identities() []CredentialSource
+	DeleteIdentity(id []byte) bool
+	UpdateIdentityUser(id []byte, user PublicKeyCrendentialUserEntity) bool
 
 	SealingEncryptionKey() []byte
 	NewPrivateKey() *ecdsa.PrivateKey
 	NewAuthenticationCounterId() uint32
 	CreateAttestationCertificiate(privateKey *ecdsa.PrivateKey) []byte
+	AttestationType() AttestationType
+	AttestationFormats() []AttestationFormat
+	AttestationKey() (*ecdsa.PrivateKey, [][]byte)
+	EnterpriseAttestationKey() (*ecdsa.PrivateKey, [][]byte)
+	EnterpriseAttestationRPIDs() []string
 
 	PINHash() []byte
 	SetPINHash(pin []byte)
 	PINRetries() int32
 	SetPINRetries(retries int32)
 	PINKeyAgreement() *ECDHKey
+	RegeneratePINKeyAgreement()
 	PINToken() []byte
+	RegeneratePINToken()
+	Reset()
+
+	CanVerifyUser() bool
+	VerifyUser(relyingParty string) bool
+	UVRetries() int32
+	SetUVRetries(retries int32)
+
+	LargeBlobs() []byte
+	SetLargeBlobs(data []byte)
+
+	AuthenticatorConfig() AuthenticatorConfig
+	SetAuthenticatorConfig(config AuthenticatorConfig)
 
-	ApproveAccountCreation(relyingParty string) bool
+	ApproveAccountCreation(relyingParty string, replaced *CredentialSource) bool
 	ApproveAccountLogin(credentialSource *CredentialSource) bool
+	ApproveCredentialExcluded(relyingParty string) bool
+	CanChooseAccount() bool
+	ChooseAccountLogin(credentialSources []*CredentialSource) *CredentialSource
+	ApproveReset() bool
+	ApproveDeviceSelection() bool
 	ApproveU2FRegistration(keyHandle *KeyHandle) bool
 	ApproveU2FAuthentication(keyHandle *KeyHandle) bool
 }
@@ -65,11 +151,25 @@ type DefaultFIDOClient struct {
 	certPrivateKey        *ecdsa.PrivateKey
 	authenticationCounter uint32
 
+	attestationType        AttestationType
+	attestationFormats     []AttestationFormat
+	attestationPrivateKey  *ecdsa.PrivateKey
+	attestationCertificate []byte
+
+	enterpriseAttestationCertificate []byte
+	enterpriseAttestationRPIDs       []string
+
 	pinToken        []byte
 	pinKeyAgreement *ECDHKey
 	pinRetries      int32
 	pinHash         []byte
 
+	userVerifier UserVerifier
+	uvRetries    int32
+
+	largeBlobs []byte
+	config     AuthenticatorConfig
+
 	vault           *IdentityVault
 	requestApprover ClientRequestApprover
 	dataSaver       ClientDataSaver
@@ -88,10 +188,14 @@ func NewClient(
 		certificateAuthority:  authorityCert,
 		certPrivateKey:        certificatePrivateKey,
 		authenticationCounter: 1,
-		pinToken:              randomBytes(16),
+		pinToken:              randomBytes(32),
 		pinKeyAgreement:       generateECDHKey(),
-		pinRetries:            8,
+		pinRetries:            ctap_MAX_PIN_RETRIES,
 		pinHash:               nil,
+		uvRetries:             ctap_MAX_UV_RETRIES,
+		largeBlobs:            ctapEmptyLargeBlobArray(),
+		config:                defaultAuthenticatorConfig(),
+		attestationFormats:    []AttestationFormat{AttestationFormatPacked, AttestationFormatFIDOU2F, AttestationFormatNone},
 		vault:                 NewIdentityVault(),
 		requestApprover:       requestApprover,
 		dataSaver:             dataSaver,
@@ -100,30 +204,47 @@ func NewClient(
 	return client
 }
 
-func (client *DefaultFIDOClient) NewCredentialSource(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity) *CredentialSource {
-	newSource := client.vault.NewIdentity(relyingParty, user)
+func (client *DefaultFIDOClient) NewCredentialSource(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity, options CredentialOptions) *CredentialSource {
+	if !options.Discoverable {
+		return newCredentialSource(relyingParty, user, options)
+	}
+	newSource := client.vault.NewIdentity(relyingParty, user, options)
 	client.saveData()
 	return newSource
 }
 
-func (client *DefaultFIDOClient) GetAssertionSource(relyingPartyID string, allowList []PublicKeyCredentialDescriptor) *CredentialSource {
-	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
+// Returns the credential sources usable for an assertion, most recently created first
+func (client *DefaultFIDOClient) GetAssertionSources(relyingPartyID string, allowList []PublicKeyCredentialDescriptor, userVerified bool) []*CredentialSource {
+	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList, userVerified)
 	if len(sources) == 0 {
 		clientLogger.Printf("ERROR: No Credentials\n\n")
 		return nil
 	}
+	newestFirst := make([]*CredentialSource, 0, len(sources))
+	for i := len(sources) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, sources[i])
+	}
+	return newestFirst
+}
 
-	// TODO: Allow user to choose credential source
-	credentialSource := sources[0]
-	credentialSource.SignatureCounter++
+func (client *DefaultFIDOClient) IncrementSignatureCounter(credentialSource *CredentialSource) {
+	if client.vault.GetIdentity(credentialSource.ID) == nil {
+		// Credentials wrapped in their ID have nowhere to keep a counter, so they share the device counter
+		credentialSource.SignatureCounter = int32(client.NewAuthenticationCounterId())
+	} else {
+		credentialSource.SignatureCounter++
+	}
 	client.saveData()
-	return credentialSource
 }
 
-func (client DefaultFIDOClient) ApproveAccountCreation(relyingParty string) bool {
+func (client DefaultFIDOClient) ApproveAccountCreation(relyingParty string, replaced *CredentialSource) bool {
 	params := ClientActionRequestParams{
 		RelyingParty: relyingParty,
 	}
+	if replaced != nil {
+		params.UserName = replaced.User.Name
+		params.ReplacesAccount = true
+	}
 	return client.requestApprover.ApproveClientAction(ClientActionFIDOMakeCredential, params)
 }
 
@@ -135,6 +256,45 @@ func (client DefaultFIDOClient) ApproveAccountLogin(credentialSource *Credential
 	return client.requestApprover.ApproveClientAction(ClientActionFIDOGetAssertion, params)
 }
 
+func (client DefaultFIDOClient) ApproveCredentialExcluded(relyingParty string) bool {
+	params := ClientActionRequestParams{
+		RelyingParty: relyingParty,
+	}
+	return client.requestApprover.ApproveClientAction(ClientActionFIDOCredentialExcluded, params)
+}
+
+func (client DefaultFIDOClient) ApproveReset() bool {
+	return client.requestApprover.ApproveClientAction(ClientActionFIDOReset, ClientActionRequestParams{})
+}
+
+func (client DefaultFIDOClient) ApproveDeviceSelection() bool {
+	return client.requestApprover.ApproveClientAction(ClientActionFIDOSelectDevice, ClientActionRequestParams{})
+}
+
+func (client DefaultFIDOClient) CanChooseAccount() bool {
+	_, ok := client.requestApprover.(ClientAccountChooser)
+	return ok
+}
+
+func (client DefaultFIDOClient) ChooseAccountLogin(credentialSources []*CredentialSource) *CredentialSource {
+	chooser, ok := client.requestApprover.(ClientAccountChooser)
+	if !ok {
+		return nil
+	}
+	accounts := make([]ClientActionRequestParams, 0, len(credentialSources))
+	for _, source := range credentialSources {
+		accounts = append(accounts, ClientActionRequestParams{
+			RelyingParty: source.RelyingParty.Name,
+			UserName:     source.User.Name,
+		})
+	}
+	choice := chooser.ChooseAccount(accounts)
+	if choice < 0 || choice >= len(credentialSources) {
+		return nil
+	}
+	return credentialSources[choice]
+}
+
 // -----------------------
 // PIN Management Methods
 // -----------------------
@@ -148,23 +308,101 @@ func (client *DefaultFIDOClient) SetPINHash(newHash []byte) {
 	client.saveData()
 }
 
+// Returns the PIN attempts left, or 0 if the PIN is blocked until the device is reset
 func (client *DefaultFIDOClient) PINRetries() int32 {
-	assert(client.pinRetries > 0 && client.pinRetries <= 8, "Invalid PIN Retries")
 	return client.pinRetries
 }
 
+// PIN retries are saved so that restarting the device doesn't allow more guesses
 func (client *DefaultFIDOClient) SetPINRetries(retries int32) {
 	client.pinRetries = retries
+	client.saveData()
 }
 
 func (client *DefaultFIDOClient) PINKeyAgreement() *ECDHKey {
 	return client.pinKeyAgreement
 }
 
+func (client *DefaultFIDOClient) RegeneratePINKeyAgreement() {
+	client.pinKeyAgreement = generateECDHKey()
+}
+
 func (client *DefaultFIDOClient) PINToken() []byte {
 	return client.pinToken
 }
 
+func (client *DefaultFIDOClient) RegeneratePINToken() {
+	client.pinToken = randomBytes(32)
+}
+
+// Wipes all credentials and PIN state, as if the device was new
+func (client *DefaultFIDOClient) Reset() {
+	client.vault = NewIdentityVault()
+	// Credentials that are not in the vault are sealed in their ID, so changing
+	// the key invalidates them along with U2F key handles
+	client.deviceEncryptionKey = randomBytes(32)
+	client.pinHash = nil
+	client.pinRetries = ctap_MAX_PIN_RETRIES
+	client.uvRetries = ctap_MAX_UV_RETRIES
+	client.RegeneratePINToken()
+	client.RegeneratePINKeyAgreement()
+	client.largeBlobs = ctapEmptyLargeBlobArray()
+	client.config = defaultAuthenticatorConfig()
+	client.saveData()
+}
+
+// -----------------------------
+// User Verification Methods
+// -----------------------------
+
+// Enables built-in user verification, performed by the given verifier
+func (client *DefaultFIDOClient) SetUserVerifier(verifier UserVerifier) {
+	client.userVerifier = verifier
+}
+
+func (client *DefaultFIDOClient) CanVerifyUser() bool {
+	return client.userVerifier != nil
+}
+
+func (client *DefaultFIDOClient) VerifyUser(relyingParty string) bool {
+	if client.userVerifier == nil {
+		return false
+	}
+	return client.userVerifier.VerifyUser(ClientActionRequestParams{RelyingParty: relyingParty})
+}
+
+func (client *DefaultFIDOClient) UVRetries() int32 {
+	return client.uvRetries
+}
+
+// UV retries are saved so that the lockout survives restarts
+func (client *DefaultFIDOClient) SetUVRetries(retries int32) {
+	client.uvRetries = retries
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) AuthenticatorConfig() AuthenticatorConfig {
+	return client.config
+}
+
+func (client *DefaultFIDOClient) SetAuthenticatorConfig(config AuthenticatorConfig) {
+	client.config = config
+	client.saveData()
+}
+
+// -----------------------------
+// Large Blob Methods
+// -----------------------------
+
+func (client *DefaultFIDOClient) LargeBlobs() []byte {
+	return client.largeBlobs
+}
+
+func (client *DefaultFIDOClient) SetLargeBlobs(data []byte) {
+	client.largeBlobs = data
+	client.saveData()
+}
+
 // -----------------------------
 // U2F Methods
 // -----------------------------
@@ -186,6 +424,11 @@ func (client *DefaultFIDOClient) NewAuthenticationCounterId() uint32 {
 }
 
 func (client *DefaultFIDOClient) CreateAttestationCertificiate(privateKey *ecdsa.PrivateKey) []byte {
+	return client.createAttestationCertificate(&privateKey.PublicKey, nil, nil)
+}
+
+// A non-nil serial number makes the certificate uniquely identify this device
+func (client *DefaultFIDOClient) createAttestationCertificate(publicKey *ecdsa.PublicKey, serialNumber []byte, extensions []pkix.Extension) []byte {
 	// TODO: Fill in fields like SerialNumber and SubjectKeyIdentifier
 	templateCert := &x509.Certificate{
 		Version:      2,
@@ -202,12 +445,75 @@ func (client *DefaultFIDOClient) CreateAttestationCertificiate(privateKey *ecdsa
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		IsCA:                  false,
 		BasicConstraintsValid: true,
+		ExtraExtensions:       extensions,
+	}
+	if serialNumber != nil {
+		templateCert.SerialNumber = new(big.Int).SetBytes(serialNumber)
+		templateCert.Subject.SerialNumber = hex.EncodeToString(serialNumber)
 	}
-	certBytes, err := x509.CreateCertificate(rand.Reader, templateCert, client.certificateAuthority, &privateKey.PublicKey, client.certPrivateKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, templateCert, client.certificateAuthority, publicKey, client.certPrivateKey)
 	checkErr(err, "Could not generate attestation certificate")
 	return certBytes
 }
 
+func (client *DefaultFIDOClient) AttestationType() AttestationType {
+	return client.attestationType
+}
+
+func (client *DefaultFIDOClient) SetAttestationType(attestationType AttestationType) {
+	client.attestationType = attestationType
+}
+
+// Formats the client allows for attestation statements, in order of preference. The platform
+// may pick another allowed format through its attestationFormatsPreference.
+func (client *DefaultFIDOClient) AttestationFormats() []AttestationFormat {
+	return client.attestationFormats
+}
+
+func (client *DefaultFIDOClient) SetAttestationFormats(formats ...AttestationFormat) {
+	client.attestationFormats = formats
+}
+
+// Extensions of device attestation certificates, identifying the authenticator model by its AAGUID
+func attestationExtensions() []pkix.Extension {
+	aaguidExtension, err := asn1.Marshal(aaguid[:])
+	checkErr(err, "Could not encode AAGUID extension")
+	return []pkix.Extension{{Id: attestationAAGUIDExtensionID, Value: aaguidExtension}}
+}
+
+// Returns the device attestation key and its certificate chain, creating them on first use
+func (client *DefaultFIDOClient) AttestationKey() (*ecdsa.PrivateKey, [][]byte) {
+	if client.attestationPrivateKey == nil {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		checkErr(err, "Could not generate attestation private key")
+		client.attestationPrivateKey = privateKey
+		client.attestationCertificate = client.createAttestationCertificate(&privateKey.PublicKey, nil, attestationExtensions())
+		client.saveData()
+	}
+	return client.attestationPrivateKey, [][]byte{client.attestationCertificate, client.certificateAuthority.Raw}
+}
+
+// Returns the device attestation key with a certificate chain carrying the device's serial number,
+// for relying parties allowed to receive enterprise attestation
+func (client *DefaultFIDOClient) EnterpriseAttestationKey() (*ecdsa.PrivateKey, [][]byte) {
+	privateKey, _ := client.AttestationKey()
+	if client.enterpriseAttestationCertificate == nil {
+		serialNumber := randomBytes(16)
+		client.enterpriseAttestationCertificate = client.createAttestationCertificate(&privateKey.PublicKey, serialNumber, attestationExtensions())
+		client.saveData()
+	}
+	return privateKey, [][]byte{client.enterpriseAttestationCertificate, client.certificateAuthority.Raw}
+}
+
+// Relying parties that receive enterprise attestation when the platform requests the vendor-facilitated mode
+func (client *DefaultFIDOClient) EnterpriseAttestationRPIDs() []string {
+	return client.enterpriseAttestationRPIDs
+}
+
+func (client *DefaultFIDOClient) SetEnterpriseAttestationRPIDs(rpIDs ...string) {
+	client.enterpriseAttestationRPIDs = rpIDs
+}
+
 func (client DefaultFIDOClient) ApproveU2FRegistration(keyHandle *KeyHandle) bool {
 	params := ClientActionRequestParams{}
 	return client.requestApprover.ApproveClientAction(ClientActionU2FRegister, params)
@@ -228,7 +534,18 @@ func (client *DefaultFIDOClient) exportData(passphrase string) []byte {
 		AttestationPrivateKey:  privKeyBytes,
 		AuthenticationCounter:  client.authenticationCounter,
 		PINHash:                client.pinHash,
+		PINRetries:             &client.pinRetries,
 		Sources:                identityData,
+		LargeBlobs:             client.largeBlobs,
+		Config:                 &client.config,
+		UVRetries:              &client.uvRetries,
+	}
+	if client.attestationPrivateKey != nil {
+		attestationKeyBytes, err := x509.MarshalECPrivateKey(client.attestationPrivateKey)
+		checkErr(err, "Could not marshal device attestation key")
+		state.DeviceAttestationPrivateKey = attestationKeyBytes
+		state.DeviceAttestationCertificate = client.attestationCertificate
+		state.DeviceEnterpriseAttestationCertificate = client.enterpriseAttestationCertificate
 	}
 	savedBytes, err := EncryptWithPassphrase(state, passphrase)
 	checkErr(err, "Could not encode saved state")
@@ -247,6 +564,27 @@ func (client *DefaultFIDOClient) importData(data []byte, passphrase string) erro
 	client.certPrivateKey = privateKey
 	client.authenticationCounter = state.AuthenticationCounter
 	client.pinHash = state.PINHash
+	if state.PINRetries != nil {
+		client.pinRetries = *state.PINRetries
+	}
+	if state.LargeBlobs != nil {
+		client.largeBlobs = state.LargeBlobs
+	}
+	if state.Config != nil {
+		client.config = *state.Config
+	}
+	if state.UVRetries != nil {
+		client.uvRetries = *state.UVRetries
+	}
+	if state.DeviceAttestationPrivateKey != nil {
+		attestationKey, err := x509.ParseECPrivateKey(state.DeviceAttestationPrivateKey)
+		if err != nil {
+			return fmt.Errorf("Invalid device attestation key: %w", err)
+		}
+		client.attestationPrivateKey = attestationKey
+		client.attestationCertificate = state.DeviceAttestationCertificate
+		client.enterpriseAttestationCertificate = state.DeviceEnterpriseAttestationCertificate
+	}
 	client.vault = NewIdentityVault()
 	client.vault.Import(state.Sources)
 	return nil
@@ -279,3 +617,14 @@ func (client *DefaultFIDOClient) DeleteIdentity(id []byte) bool {
 	}
 	return success
 }
+
+func (client *DefaultFIDOClient) UpdateIdentityUser(id []byte, user PublicKeyCrendentialUserEntity) bool {
+	source := client.vault.GetIdentity(id)
+	if source == nil {
+		return false
+	}
+	source.User.Name = user.Name
+	source.User.DisplayName = user.DisplayName
+	client.saveData()
+	return true
+}
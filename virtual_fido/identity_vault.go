@@ -2,20 +2,43 @@ package virtual_fido
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto"
 	"crypto/rand"
-	"crypto/x509"
 	"fmt"
 )
 
+// How strongly a credential is protected against use without user verification,
+// as requested through the credProtect extension
+type CredentialProtection uint8
+
+const (
+	CredentialProtectionUVOptional                     CredentialProtection = 1
+	CredentialProtectionUVOptionalWithCredentialIDList CredentialProtection = 2
+	CredentialProtectionUVRequired                     CredentialProtection = 3
+)
+
 type CredentialSource struct {
 	Type             string
 	ID               []byte
-	PrivateKey       *ecdsa.PrivateKey
+	PrivateKey       crypto.Signer
 	RelyingParty     PublicKeyCredentialRpEntity
 	User             PublicKeyCrendentialUserEntity
 	SignatureCounter int32
+	LargeBlobKey     []byte
+	CredRandom       []byte
+	CredProtect      CredentialProtection
+	CredBlob         []byte
+}
+
+// Optional features requested by the relying party when creating a credential
+type CredentialOptions struct {
+	Algorithm coseAlgorithmID
+	// Discoverable credentials are stored in the vault, others are wrapped in their ID
+	Discoverable bool
+	LargeBlobKey bool
+	HMACSecret   bool
+	CredProtect  CredentialProtection
+	CredBlob     []byte
 }
 
 func (source *CredentialSource) ctapDescriptor() PublicKeyCredentialDescriptor {
@@ -35,10 +58,26 @@ func NewIdentityVault() *IdentityVault {
 	return &IdentityVault{CredentialSources: sources}
 }
 
-func (vault *IdentityVault) NewIdentity(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity) *CredentialSource {
+// Whether the credential may be used, given whether the user was verified and whether
+// the platform named the credential in an allow list
+func (source *CredentialSource) usable(userVerified bool, allowListed bool) bool {
+	switch source.CredProtect {
+	case CredentialProtectionUVRequired:
+		return userVerified
+	case CredentialProtectionUVOptionalWithCredentialIDList:
+		return userVerified || allowListed
+	default:
+		return true
+	}
+}
+
+func newCredentialSource(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity, options CredentialOptions) *CredentialSource {
 	credentialID := read(rand.Reader, 16)
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	checkErr(err, "Could not generate private key")
+	algorithm := options.Algorithm
+	if algorithm == 0 {
+		algorithm = cose_ALGORITHM_ID_ES256
+	}
+	privateKey := generatePrivateKey(algorithm)
 	credentialSource := CredentialSource{
 		Type:             "public-key",
 		ID:               credentialID,
@@ -46,11 +85,34 @@ func (vault *IdentityVault) NewIdentity(relyingParty PublicKeyCredentialRpEntity
 		RelyingParty:     relyingParty,
 		User:             user,
 		SignatureCounter: 0,
+		CredProtect:      options.CredProtect,
+		CredBlob:         options.CredBlob,
+	}
+	if credentialSource.CredProtect == 0 {
+		credentialSource.CredProtect = CredentialProtectionUVOptional
+	}
+	if options.LargeBlobKey {
+		credentialSource.LargeBlobKey = randomBytes(32)
+	}
+	if options.HMACSecret {
+		credentialSource.CredRandom = randomBytes(2 * ctap_HMAC_SECRET_CRED_RANDOM_LENGTH)
 	}
-	vault.AddIdentity(&credentialSource)
 	return &credentialSource
 }
 
+func (vault *IdentityVault) NewIdentity(relyingParty PublicKeyCredentialRpEntity, user PublicKeyCrendentialUserEntity, options CredentialOptions) *CredentialSource {
+	credentialSource := newCredentialSource(relyingParty, user, options)
+	// Only one credential is kept per user of a relying party
+	for _, source := range vault.CredentialSources {
+		if source.RelyingParty.Id == relyingParty.Id && bytes.Equal(source.User.Id, user.Id) {
+			vault.DeleteIdentity(source.ID)
+			break
+		}
+	}
+	vault.AddIdentity(credentialSource)
+	return credentialSource
+}
+
 func (vault *IdentityVault) AddIdentity(source *CredentialSource) {
 	vault.CredentialSources = append(vault.CredentialSources, source)
 }
@@ -58,28 +120,38 @@ func (vault *IdentityVault) AddIdentity(source *CredentialSource) {
 func (vault *IdentityVault) DeleteIdentity(id []byte) bool {
 	for i, source := range vault.CredentialSources {
 		if bytes.Equal(source.ID, id) {
-			vault.CredentialSources[i] = vault.CredentialSources[len(vault.CredentialSources)-1]
-			vault.CredentialSources = vault.CredentialSources[:len(vault.CredentialSources)-1]
+			// Keep creation order, since assertions list the newest credentials first
+			vault.CredentialSources = append(vault.CredentialSources[:i], vault.CredentialSources[i+1:]...)
 			return true
 		}
 	}
 	return false
 }
 
-func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string, allowList []PublicKeyCredentialDescriptor) []*CredentialSource {
+func (vault *IdentityVault) GetIdentity(id []byte) *CredentialSource {
+	for _, source := range vault.CredentialSources {
+		if bytes.Equal(source.ID, id) {
+			return source
+		}
+	}
+	return nil
+}
+
+func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string, allowList []PublicKeyCredentialDescriptor, userVerified bool) []*CredentialSource {
 	sources := make([]*CredentialSource, 0)
 	for _, credentialSource := range vault.CredentialSources {
-		if credentialSource.RelyingParty.Id == relyingPartyID {
-			if allowList != nil {
-				for _, allowedSource := range allowList {
-					if bytes.Equal(allowedSource.Id, credentialSource.ID) {
-						sources = append(sources, credentialSource)
-						break
-					}
+		if credentialSource.RelyingParty.Id != relyingPartyID || !credentialSource.usable(userVerified, len(allowList) > 0) {
+			continue
+		}
+		if len(allowList) > 0 {
+			for _, allowedSource := range allowList {
+				if bytes.Equal(allowedSource.Id, credentialSource.ID) {
+					sources = append(sources, credentialSource)
+					break
 				}
-			} else {
-				sources = append(sources, credentialSource)
 			}
+		} else {
+			sources = append(sources, credentialSource)
 		}
 	}
 	return sources
@@ -88,15 +160,17 @@ func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string,
 func (vault *IdentityVault) Export() []SavedCredentialSource {
 	sources := make([]SavedCredentialSource, 0)
 	for _, source := range vault.CredentialSources {
-		key, err := x509.MarshalECPrivateKey(source.PrivateKey)
-		checkErr(err, "Could not marshall private key")
 		savedSource := SavedCredentialSource{
 			Type:             source.Type,
 			ID:               source.ID,
-			PrivateKey:       key,
+			PrivateKey:       marshalPrivateKey(source.PrivateKey),
 			RelyingParty:     source.RelyingParty,
 			User:             source.User,
 			SignatureCounter: source.SignatureCounter,
+			LargeBlobKey:     source.LargeBlobKey,
+			CredRandom:       source.CredRandom,
+			CredProtect:      uint8(source.CredProtect),
+			CredBlob:         source.CredBlob,
 		}
 		sources = append(sources, savedSource)
 	}
@@ -105,7 +179,7 @@ func (vault *IdentityVault) Export() []SavedCredentialSource {
 
 func (vault *IdentityVault) Import(sources []SavedCredentialSource) error {
 	for _, source := range sources {
-		key, err := x509.ParseECPrivateKey(source.PrivateKey)
+		key, err := parsePrivateKey(source.PrivateKey)
 		if err != nil {
 			return fmt.Errorf("Invalid private key for source: %w", err)
 		}
@@ -116,6 +190,10 @@ func (vault *IdentityVault) Import(sources []SavedCredentialSource) error {
 			RelyingParty:     source.RelyingParty,
 			User:             source.User,
 			SignatureCounter: source.SignatureCounter,
+			LargeBlobKey:     source.LargeBlobKey,
+			CredRandom:       source.CredRandom,
+			CredProtect:      CredentialProtection(source.CredProtect),
+			CredBlob:         source.CredBlob,
 		}
 		vault.AddIdentity(&decodedSource)
 	}
@@ -15,15 +15,26 @@ type SavedCredentialSource struct {
 	RelyingParty     PublicKeyCredentialRpEntity    `json:"relying_party"`
 	User             PublicKeyCrendentialUserEntity `json:"user"`
 	SignatureCounter int32                          `json:"signature_counter"`
+	LargeBlobKey     []byte                         `json:"large_blob_key,omitempty"`
+	CredRandom       []byte                         `json:"cred_random,omitempty"`
+	CredProtect      uint8                          `json:"cred_protect,omitempty"`
+	CredBlob         []byte                         `json:"cred_blob,omitempty"`
 }
 
 type FIDODeviceConfig struct {
-	EncryptionKey          []byte                  `json:"encryption_key"`
-	AttestationCertificate []byte                  `json:"attestation_certificate"`
-	AttestationPrivateKey  []byte                  `json:"attestation_private_key"`
-	AuthenticationCounter  uint32                  `json:"authentication_counter"`
-	PINHash                []byte                  `json:"pin_hash,omitempty"`
-	Sources                []SavedCredentialSource `json:"sources"`
+	EncryptionKey                          []byte                  `json:"encryption_key"`
+	AttestationCertificate                 []byte                  `json:"attestation_certificate"`
+	AttestationPrivateKey                  []byte                  `json:"attestation_private_key"`
+	AuthenticationCounter                  uint32                  `json:"authentication_counter"`
+	PINHash                                []byte                  `json:"pin_hash,omitempty"`
+	PINRetries                             *int32                  `json:"pin_retries,omitempty"`
+	Sources                                []SavedCredentialSource `json:"sources"`
+	LargeBlobs                             []byte                  `json:"large_blobs,omitempty"`
+	Config                                 *AuthenticatorConfig    `json:"config,omitempty"`
+	UVRetries                              *int32                  `json:"uv_retries,omitempty"`
+	DeviceAttestationPrivateKey            []byte                  `json:"device_attestation_private_key,omitempty"`
+	DeviceAttestationCertificate           []byte                  `json:"device_attestation_certificate,omitempty"`
+	DeviceEnterpriseAttestationCertificate []byte                  `json:"device_enterprise_attestation_certificate,omitempty"`
 }
 
 type PassphraseEncryptedBlob struct {
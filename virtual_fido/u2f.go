@@ -2,6 +2,7 @@ package virtual_fido
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/x509"
 	"fmt"
@@ -100,12 +101,18 @@ func (server *u2fServer) handleU2FMessage(message []byte) []byte {
 	switch header.Command {
 	case u2f_COMMAND_VERSION:
 		response = append([]byte("U2F_V2"), toBE(u2f_SW_NO_ERROR)...)
-	case u2f_COMMAND_REGISTER:
-		response = server.handleU2FRegister(header, request)
-	case u2f_COMMAND_AUTHENTICATE:
-		response = server.handleU2FAuthenticate(header, request)
+	case u2f_COMMAND_REGISTER, u2f_COMMAND_AUTHENTICATE:
+		if server.client.AuthenticatorConfig().AlwaysUV {
+			// U2F can't verify the user, so it is disabled when UV is always required
+			response = toBE(u2f_SW_INS_NOT_SUPPORTED)
+		} else if header.Command == u2f_COMMAND_REGISTER {
+			response = server.handleU2FRegister(header, request)
+		} else {
+			response = server.handleU2FAuthenticate(header, request)
+		}
 	default:
-		panic(fmt.Sprintf("Invalid U2F Command: %#v", header))
+		u2fLogger.Printf("ERROR: Invalid U2F Command: %#v\n\n", header)
+		response = toBE(u2f_SW_INS_NOT_SUPPORTED)
 	}
 	u2fLogger.Printf("U2F RESPONSE: %#v\n\n", response)
 	return response
@@ -121,15 +128,32 @@ func (server *u2fServer) sealKeyHandle(keyHandle *KeyHandle) []byte {
 	return marshalCBOR(box)
 }
 
+// Returns nil for key handles that weren't sealed by this device
 func (server *u2fServer) openKeyHandle(boxBytes []byte) *KeyHandle {
+	keyHandle, err := decodeKeyHandle(server.client.SealingEncryptionKey(), boxBytes)
+	if err != nil {
+		u2fLogger.Printf("ERROR: Could not open key handle: %s\n\n", err)
+		return nil
+	}
+	return keyHandle
+}
+
+func decodeKeyHandle(key []byte, boxBytes []byte) (*KeyHandle, error) {
 	var box encryptedBox
 	err := cbor.Unmarshal(boxBytes, &box)
-	checkErr(err, "Could not decode encrypted box")
-	data := open(server.client.SealingEncryptionKey(), box)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode encrypted box: %w", err)
+	}
+	data, err := decrypt(key, box.Data, box.IV)
+	if err != nil {
+		return nil, err
+	}
 	var keyHandle KeyHandle
 	err = cbor.Unmarshal(data, &keyHandle)
-	checkErr(err, "Could not decode key handle")
-	return &keyHandle
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode key handle: %w", err)
+	}
+	return &keyHandle, nil
 }
 
 func (server *u2fServer) handleU2FRegister(header u2fMessageHeader, request []byte) []byte {
@@ -168,12 +192,17 @@ func (server *u2fServer) handleU2FAuthenticate(header u2fMessageHeader, request
 	keyHandleLength := readLE[uint8](requestReader)
 	encryptedKeyHandleBytes := read(requestReader, uint(keyHandleLength))
 	keyHandle := server.openKeyHandle(encryptedKeyHandleBytes)
-	if keyHandle.PrivateKey == nil || bytes.Compare(keyHandle.ApplicationID, application) != 0 {
+	if keyHandle == nil || keyHandle.PrivateKey == nil || bytes.Compare(keyHandle.ApplicationID, application) != 0 {
 		u2fLogger.Printf("U2F AUTHENTICATE: Invalid input data %#v\n\n", keyHandle)
 		return toBE(u2f_SW_WRONG_DATA)
 	}
-	privateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
-	checkErr(err, "Could not decode private key")
+	// Credential IDs from CTAP2 can hold any kind of key, but U2F only signs with P-256
+	signer, err := parsePrivateKey(keyHandle.PrivateKey)
+	privateKey, ok := signer.(*ecdsa.PrivateKey)
+	if err != nil || !ok || privateKey.Curve != elliptic.P256() {
+		u2fLogger.Printf("U2F AUTHENTICATE: Key handle does not contain a P-256 key\n\n")
+		return toBE(u2f_SW_WRONG_DATA)
+	}
 
 	if control == u2f_AUTH_CONTROL_CHECK_ONLY {
 		return toBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
@@ -10,6 +10,7 @@ import (
 type usbDevice interface {
 	handleMessage(id uint32, onFinish func(), endpoint uint32, setup usbSetupPacket, transferBuffer []byte)
 	removeWaitingRequest(id uint32) bool
+	powerUp()
 	usbipSummary() usbipDeviceSummary
 	usbipSummaryHeader() usbipDeviceSummaryHeader
 }
@@ -296,6 +297,10 @@ func (device *usbDeviceImpl) removeWaitingRequest(id uint32) bool {
 	return device.ctapHIDServer.removeWaitingRequest(id)
 }
 
+func (device *usbDeviceImpl) powerUp() {
+	device.ctapHIDServer.powerUp()
+}
+
 func (device *usbDeviceImpl) handleMessage(id uint32, onFinish func(), endpoint uint32, setup usbSetupPacket, transferBuffer []byte) {
 	usbLogger.Printf("USB MESSAGE - ENDPOINT %d\n\n", endpoint)
 	if endpoint == 0 {
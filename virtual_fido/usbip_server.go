@@ -55,6 +55,7 @@ func (server *usbIPServer) handleConnection(conn *net.Conn) {
 			reply := newOpRepImport(server.device)
 			usbipLogger.Printf("[OP_REP_IMPORT] %s\n\n", reply)
 			write(*conn, toBE(reply))
+			server.device.powerUp()
 			server.handleCommands(conn)
 		}
 	}
@@ -184,8 +184,16 @@ func bytesToBigInt(b []byte) *big.Int {
 	return big.NewInt(0).SetBytes(b)
 }
 
+// Everything the device encodes uses CTAP2 canonical CBOR: sorted map keys, definite lengths
+// and no tags, which strict platforms require
+var cborEncMode = func() cbor.EncMode {
+	mode, err := cbor.CTAP2EncOptions().EncMode()
+	checkErr(err, "Could not create CBOR encoding mode")
+	return mode
+}()
+
 func marshalCBOR(val interface{}) []byte {
-	data, err := cbor.Marshal(val)
+	data, err := cborEncMode.Marshal(val)
 	checkErr(err, "Could not marshal CBOR")
 	return data
 }